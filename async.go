@@ -0,0 +1,125 @@
+package slogconsole
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultAsyncQueueSize = 1024
+
+// QueueFullPolicy tells what to do with a record if the AsyncWrite queue is full
+type QueueFullPolicy int
+
+const (
+	// QueueFullBlock waits for the free space in the queue
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullDrop drops the record and counts it, see ConsoleHandler.Dropped
+	QueueFullDrop
+)
+
+type asyncEntry struct {
+	lv  slog.Level
+	buf *buffer
+	ts  stamp
+}
+
+// asyncWriter writes lines queued by Handle in a single goroutine
+type asyncWriter struct {
+	// guards closed against sends to the closed queue
+	mu     sync.RWMutex
+	closed bool
+
+	queue   chan asyncEntry
+	done    chan struct{}
+	drop    bool
+	dropped atomic.Uint64
+	// first write error, may be read after done
+	err error
+}
+
+func newAsyncWriter(h *ConsoleHandler) *asyncWriter {
+	size := h.opts.AsyncQueueSize
+	if size <= 0 {
+		size = defaultAsyncQueueSize
+	}
+
+	aw := &asyncWriter{
+		queue: make(chan asyncEntry, size),
+		done:  make(chan struct{}),
+		drop:  h.opts.OnQueueFull == QueueFullDrop,
+	}
+	go aw.drain(h)
+
+	return aw
+}
+
+func (aw *asyncWriter) drain(h *ConsoleHandler) {
+	defer close(aw.done)
+
+	for e := range aw.queue {
+		if err := h.write(e.lv, e.buf, e.ts); err != nil && aw.err == nil {
+			aw.err = err
+		}
+		e.buf.free()
+	}
+}
+
+// send queues or drops the buffer, it returns false if the writer is closed
+func (aw *asyncWriter) send(lv slog.Level, buf *buffer, ts stamp) bool {
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+
+	if aw.closed {
+		return false
+	}
+
+	if !aw.drop {
+		aw.queue <- asyncEntry{lv: lv, buf: buf, ts: ts}
+		return true
+	}
+
+	select {
+	case aw.queue <- asyncEntry{lv: lv, buf: buf, ts: ts}:
+	default:
+		aw.dropped.Add(1)
+		buf.free()
+	}
+
+	return true
+}
+
+func (aw *asyncWriter) close() error {
+	aw.mu.Lock()
+	if !aw.closed {
+		aw.closed = true
+		close(aw.queue)
+	}
+	aw.mu.Unlock()
+
+	<-aw.done
+
+	return aw.err
+}
+
+// Close writes queued records and stops the writer goroutine if
+// Options.AsyncWrite is on. It returns the first write error of the queue.
+// Records handled after Close are written synchronously.
+// Handlers derived with WithAttrs and WithGroup share the queue
+func (h *ConsoleHandler) Close() error {
+	if h.async == nil {
+		return nil
+	}
+
+	return h.async.close()
+}
+
+// Dropped returns the number of records dropped because of the full
+// AsyncWrite queue, see Options.OnQueueFull
+func (h *ConsoleHandler) Dropped() uint64 {
+	if h.async == nil {
+		return 0
+	}
+
+	return h.async.dropped.Load()
+}
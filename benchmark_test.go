@@ -4,6 +4,7 @@ import (
 	"io"
 	"log/slog"
 	"testing"
+	"time"
 )
 
 func BenchmarkAttrs(b *testing.B) {
@@ -112,3 +113,100 @@ func BenchmarkAttrs(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkBareMessage(b *testing.B) {
+	for _, ho := range []struct {
+		name string
+		opts *Options
+	}{
+		{"plain", &Options{}},
+		{"colorized", &Options{Colorize: newBoolBar(true)}},
+	} {
+		logger := slog.New(New(io.Discard, ho.opts))
+		b.Run(ho.name, func(b *testing.B) {
+			f := func() {
+				logger.Info(testMessage)
+			}
+			if n := testing.AllocsPerRun(100, f); n != 0 {
+				b.Fatalf("got %v allocs/op, want 0", n)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f()
+			}
+		})
+	}
+}
+
+// slowWriter imitates a writer with a syscall cost
+type slowWriter struct{}
+
+func (slowWriter) Write(p []byte) (int, error) {
+	for start := time.Now(); time.Since(start) < time.Microsecond; {
+	}
+	return len(p), nil
+}
+
+func BenchmarkAsyncWrite(b *testing.B) {
+	for _, ho := range []struct {
+		name string
+		opts *Options
+	}{
+		{"sync", &Options{}},
+		{"async", &Options{AsyncWrite: true}},
+	} {
+		b.Run(ho.name, func(b *testing.B) {
+			hd := New(slowWriter{}, ho.opts)
+			logger := slog.New(hd)
+
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					logger.LogAttrs(nil, slog.LevelInfo, testMessage,
+						slog.String("string", testString),
+						slog.Int("status", testInt),
+						slog.Duration("duration", testDuration),
+					)
+				}
+			})
+			hd.Close()
+		})
+	}
+}
+
+func BenchmarkNeedsQuoting(b *testing.B) {
+	for _, s := range []string{
+		"GET",
+		"200",
+		"/api/v1/users",
+		"550e8400-e29b-41d4-a716-446655440000",
+		"connection reset by peer",
+		"привет",
+	} {
+		b.Run(s, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				needsQuoting(s)
+			}
+		})
+	}
+}
+
+func BenchmarkSource(b *testing.B) {
+	for _, ho := range []struct {
+		name string
+		opts *Options
+	}{
+		{"no cache", &Options{AddSource: true}},
+		{"cache", &Options{AddSource: true, SourceCacheSize: 64}},
+	} {
+		logger := slog.New(New(io.Discard, ho.opts))
+		b.Run(ho.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				logger.Info(testMessage)
+			}
+		})
+	}
+}
@@ -2,29 +2,74 @@ package slogconsole
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // Buffer adapted from go/src/fmt/print.go
 type buffer []byte
 
-// Having an initial size gives a dramatic speedup.
-var bufPool = sync.Pool{
-	New: func() any {
-		b := make([]byte, 0, 1024)
-		return (*buffer)(&b)
-	},
+// bufferPool is the source of the line buffers, replaced in tests to track them
+type bufferPool interface {
+	get() *buffer
+	put(*buffer)
+}
+
+type syncBufferPool struct {
+	p sync.Pool
+}
+
+func (sp *syncBufferPool) get() *buffer {
+	return sp.p.Get().(*buffer)
+}
+
+func (sp *syncBufferPool) put(b *buffer) {
+	sp.p.Put(b)
+}
+
+func newSyncBufferPool() *syncBufferPool {
+	return &syncBufferPool{
+		p: sync.Pool{
+			// Having an initial size gives a dramatic speedup.
+			New: func() any {
+				b := make([]byte, 0, 1024)
+				return (*buffer)(&b)
+			},
+		},
+	}
+}
+
+var bufPool bufferPool = newSyncBufferPool()
+
+// To reduce peak allocation, return only smaller buffers to the pool.
+const defaultMaxBufferSize = 16 << 10
+
+var maxBufferSize atomic.Int64
+
+func init() {
+	maxBufferSize.Store(defaultMaxBufferSize)
+}
+
+// SetMaxPooledBufferSize sets the capacity of the biggest line buffer
+// returned to the pool for reuse. Raise it if lines are constantly large.
+// Zero or negative size removes the limit.
+// Default: 16 KiB
+func SetMaxPooledBufferSize(size int) {
+	maxBufferSize.Store(int64(size))
 }
 
 func allocBuf() *buffer {
-	return bufPool.Get().(*buffer)
+	return bufPool.get()
+}
+
+func (b *buffer) poolable() bool {
+	limit := maxBufferSize.Load()
+	return limit <= 0 || int64(cap(*b)) <= limit
 }
 
 func (b *buffer) free() {
-	// To reduce peak allocation, return only smaller buffers to the pool.
-	const maxBufferSize = 16 << 10
-	if cap(*b) <= maxBufferSize {
+	if b.poolable() {
 		*b = (*b)[:0]
-		bufPool.Put(b)
+		bufPool.put(b)
 	}
 }
 
@@ -0,0 +1,156 @@
+package slogconsole
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+const poison = 0xA5
+
+// trackingPool never reuses buffers. Freed buffers are poisoned to find
+// writes through the references kept after free
+type trackingPool struct {
+	mu     sync.Mutex
+	inUse  map[*buffer]struct{}
+	freed  []*buffer
+	errors []string
+}
+
+func (tp *trackingPool) get() *buffer {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	b := make(buffer, 0, 1024)
+	tp.inUse[&b] = struct{}{}
+
+	return &b
+}
+
+func (tp *trackingPool) put(b *buffer) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if _, ok := tp.inUse[b]; !ok {
+		tp.errors = append(tp.errors, "free of the buffer not in use")
+		return
+	}
+	delete(tp.inUse, b)
+
+	full := (*b)[:cap(*b)]
+	for i := range full {
+		full[i] = poison
+	}
+	tp.freed = append(tp.freed, b)
+}
+
+// check reports double free, leaks and writes after free
+func (tp *trackingPool) check(t *testing.T) {
+	t.Helper()
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	for _, e := range tp.errors {
+		t.Error(e)
+	}
+	if n := len(tp.inUse); n > 0 {
+		t.Errorf("%d buffers are not freed", n)
+	}
+	for _, b := range tp.freed {
+		if len(bytes.Trim((*b)[:cap(*b)], string([]byte{poison}))) > 0 {
+			t.Error("buffer is written after free")
+		}
+	}
+}
+
+// setTrackingPool replaces the buffer pool until the test ends.
+// Tests using it must not be parallel
+func setTrackingPool(t *testing.T) *trackingPool {
+	tp := &trackingPool{inUse: make(map[*buffer]struct{})}
+
+	prev := bufPool
+	bufPool = tp
+	t.Cleanup(func() {
+		bufPool = prev
+	})
+
+	return tp
+}
+
+func TestSetMaxPooledBufferSize(t *testing.T) {
+	defer SetMaxPooledBufferSize(defaultMaxBufferSize)
+
+	b := make(buffer, 0, 20<<10)
+
+	if b.poolable() {
+		t.Error("20 KiB buffer is pooled by default")
+	}
+
+	SetMaxPooledBufferSize(32 << 10)
+	if !b.poolable() {
+		t.Error("20 KiB buffer is not pooled with 32 KiB limit")
+	}
+
+	SetMaxPooledBufferSize(0)
+	if !b.poolable() {
+		t.Error("20 KiB buffer is not pooled without limit")
+	}
+}
+
+func TestTrackingPool(t *testing.T) {
+	tp := setTrackingPool(t)
+
+	b := allocBuf()
+	b.writeString(testMessage)
+	b.free()
+	// stale reference
+	b.writeString("oops")
+	b.free()
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if len(tp.errors) != 1 {
+		t.Errorf("got %d errors, want double free", len(tp.errors))
+	}
+	if len(bytes.Trim((*tp.freed[0])[:cap(*tp.freed[0])], string([]byte{poison}))) == 0 {
+		t.Error("write after free is not detected")
+	}
+}
+
+func TestBufferPoolUsage(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts *Options
+	}{
+		{"text", &Options{}},
+		{"json", &Options{AttrsAsJSON: true}},
+		{"multiline", &Options{MultiLine: true}},
+		{"async", &Options{AsyncWrite: true}},
+		{"async drop", &Options{AsyncWrite: true, AsyncQueueSize: 1, OnQueueFull: QueueFullDrop}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tp := setTrackingPool(t)
+
+			hd := New(io.Discard, test.opts)
+			logger := slog.New(hd).With("key", testInt).WithGroup("grp")
+			for i := 0; i < 100; i++ {
+				logger.Info(testMessage, "i", i, slog.Group("inner", "s", testString))
+			}
+			if err := hd.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// after close
+			r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, 0)
+			if err := hd.Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			tp.check(t)
+		})
+	}
+}
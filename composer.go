@@ -1,17 +1,30 @@
 package slogconsole
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
 
 // Copied from slog package
 func appendValue(v slog.Value, dst []byte) []byte {
-	switch v.Kind() {
+	return appendValueKind(v.Kind(), v, dst)
+}
+
+// appendValueKind writes v of the kind k. Unknown kinds are written with fmt
+func appendValueKind(k slog.Kind, v slog.Value, dst []byte) []byte {
+	switch k {
 	case slog.KindString:
 		return appendString(dst, v.String())
 	case slog.KindInt64:
@@ -31,56 +44,286 @@ func appendValue(v slog.Value, dst []byte) []byte {
 		tmFormat := "2006-01-02 15:04:05.999999999 -0700 MST"
 		return v.Time().AppendFormat(dst, tmFormat)
 	case slog.KindGroup:
-		return fmt.Append(dst, v.Group())
-	case slog.KindAny, slog.KindLogValuer:
-		return fmt.Append(dst, v.Any())
+		return appendEscaped(dst, fmt.Append(dst, v.Group()))
+	default:
+		// slog.KindAny, slog.KindLogValuer and the kinds of the future
+		return appendEscaped(dst, fmt.Append(dst, v.Any()))
+	}
+}
+
+// appendEscaped quotes the text appended to dst if it would break the line
+// or the quoted value, spaces are kept as is. The dst is the slice before the text was appended
+func appendEscaped(dst, b []byte) []byte {
+	text := b[len(dst):]
+	if !needsEscaping(text) {
+		return b
+	}
+	return strconv.AppendQuote(dst, string(text))
+}
+
+// needsEscaping reports whether b has control characters, double quotes or invalid UTF-8
+func needsEscaping(b []byte) bool {
+	for i := 0; i < len(b); {
+		if b[i] < utf8.RuneSelf {
+			if b[i] < ' ' || b[i] == '"' || b[i] == 0x7f {
+				return true
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// knownKind reports whether appendValue knows the kind k
+func knownKind(k slog.Kind) bool {
+	return k <= slog.KindLogValuer
+}
+
+// booleanColor returns the color of true, false and nil values
+func booleanColor(v slog.Value) (string, bool) {
+	switch {
+	case v.Kind() == slog.KindBool && v.Bool():
+		return ConsoleColorGreen, true
+	case v.Kind() == slog.KindBool:
+		return ConsoleColorGray, true
+	case v.Kind() == slog.KindAny && v.Any() == nil:
+		return ConsoleColorGray, true
+	default:
+		return "", false
+	}
+}
+
+// appendSlice writes slice or array as [a,b,c], it reports false if v is not a slice.
+// Time elements are written in the tmFormat, string ones with str if it is not nil
+func appendSlice(v slog.Value, dst []byte, tmFormat string, str func([]byte, string) []byte) ([]byte, bool) {
+	rv := reflect.ValueOf(v.Any())
+	switch rv.Kind() {
+	case reflect.Slice:
+		// keep []byte as is
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return dst, false
+		}
+	case reflect.Array:
 	default:
-		panic(fmt.Sprintf("bad kind: %s", v.Kind()))
+		return dst, false
+	}
+
+	dst = append(dst, '[')
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		ev := slog.AnyValue(rv.Index(i).Interface())
+		switch {
+		case ev.Kind() == slog.KindTime:
+			dst = ev.Time().AppendFormat(dst, tmFormat)
+		case ev.Kind() == slog.KindString && str != nil:
+			dst = str(dst, ev.String())
+		default:
+			dst = appendValue(ev, dst)
+		}
 	}
+
+	return append(dst, ']'), true
+}
+
+var composerPool = sync.Pool{
+	New: func() any {
+		return new(composer)
+	},
 }
 
 func newComposer(h *ConsoleHandler) *composer {
-	return &composer{
-		buf: allocBuf(),
-		h:   h,
+	c := composerPool.Get().(*composer)
+	c.buf = allocBuf()
+	c.h = h
+	c.timeKey, c.levelKey, c.msgKey = slog.TimeKey, slog.LevelKey, slog.MessageKey
+	if h.opts.DropLevel {
+		c.levelKey = ""
 	}
+
+	return c
 }
 
 type composer struct {
-	buf  *buffer
-	h    *ConsoleHandler
-	pref string
+	buf    *buffer
+	h      *ConsoleHandler
+	pref   string
+	deltas *deltaState
+
+	// groups of the group attributes being written
+	nested []string
+	// scratch of the groups passed to Options.ReplaceAttr
+	groupPath []string
+
+	// collect attributes to fields instead of writing them,
+	// see Options.MultiLine and Options.GroupBlocks
+	collect bool
+	fields  []field
+	blocks  []string
+	// group and key of the fields, see dedupFields
+	seen map[[2]string]struct{}
+	// groups of Options.AttrsAsJSON to open before the next attribute
+	jsonGroups []string
+	// keys of the attributes written by the handler, see Options.OnKeyCollision
+	reserved []string
+	// the record is streamed at the level, see Options.Streaming.
+	// The mutex is locked on the first chunk, the writer is taken under it
+	streaming   bool
+	streamLevel slog.Level
+	stream      io.Writer
+	streamErr   error
+	// Options.MaxTotalBytes is reached by the chunks
+	rotate bool
+	// full timestamp of Options.SubSecondOnly
+	stamp stamp
+	// color of the whole line, see Options.ColorizeLine
+	lineColor   string
+	lineColored bool
+	// keys of the built-in fields, empty if Options.ReplaceAttr dropped the
+	// field. The text of the replaced values of other kinds, see replaceBuiltins
+	timeKey, levelKey, msgKey string
+	timeText, levelText       string
+}
+
+// field is an attribute with the formatted value
+type field struct {
+	// top-level group if Options.GroupBlocks or SortGrouped is on.
+	// The key is without it if Options.GroupBlocks is on
+	group string
+	key   string
+	val   string
+}
+
+// top returns the top-level group or the key of the ungrouped field
+func (f field) top() string {
+	if len(f.group) > 0 {
+		return f.group
+	}
+	return f.key
 }
 
 func (c *composer) destruct() {
-	// free buffers
-	c.buf.free()
+	// free buffers, it may be passed to the async queue
+	if c.buf != nil {
+		c.buf.free()
+	}
 
 	// free pointers
 	c.buf = nil
 	c.h = nil
+	c.pref = ""
+	c.deltas = nil
+	c.nested = c.nested[:0]
+	c.groupPath = c.groupPath[:0]
+	c.collect = false
+	c.fields = c.fields[:0]
+	c.blocks = c.blocks[:0]
+	c.jsonGroups = c.jsonGroups[:0]
+	c.reserved = c.reserved[:0]
+	c.streaming = false
+	c.stream = nil
+	c.streamErr = nil
+	c.rotate = false
+	c.stamp = stamp{}
+	c.lineColor = ""
+	c.lineColored = false
+	c.timeText = ""
+	c.levelText = ""
+
+	composerPool.Put(c)
 }
 
 func (c *composer) addSpace(add bool) {
 	if add {
-		c.buf.writeByte(' ')
+		c.buf.writeString(c.h.opts.FieldSeparator)
 	}
 }
 
-func (c *composer) appendAttr(a slog.Attr, keyPref string) {
-	a = c.optionalReplaceAttr(c.h.groups, a)
+// appendTextRecord writes the record line, see FormatText
+func (c *composer) appendTextRecord(ctx context.Context, r slog.Record) {
+	// write timestamp
+	if !c.h.opts.TimeLast {
+		c.appendTime(r.Time)
+	}
+	// write level
+	c.appendLevel(r.Level)
+	// message
+	if len(r.Message) > 0 {
+		c.addSpace(c.bufLen() > 0)
+		c.buf.writeString(r.Message)
+	}
+	// active group
+	if c.h.opts.ShowActiveGroup && len(c.h.prefix) > 0 {
+		c.addSpace(c.bufLen() > 0)
+		c.buf.writeByte('[')
+		c.buf.writeString(c.h.prefix)
+		c.buf.writeByte(']')
+	}
+	// request id from the context
+	rid := c.h.requestID(ctx)
+	if len(rid.Key) > 0 && !c.h.opts.AttrsAsJSON {
+		c.appendKeyValue(rid.Key, rid.Key, rid.Value.Resolve())
+		c.reserved = append(c.reserved, rid.Key)
+	}
+	// write source
+	c.appendSource(r.PC)
+	c.appendRecordAttrs(r, rid)
 
+	if c.h.opts.TimeLast {
+		c.appendTime(r.Time)
+	}
+}
+
+// appendRecordAttrs writes the handler and record attributes, rid is
+// the request id for AttrsAsJSON
+func (c *composer) appendRecordAttrs(r slog.Record, rid slog.Attr) {
+	switch {
+	case c.h.opts.AttrsAsJSON:
+		c.appendJSONAttrs(r, rid)
+	case c.collect:
+		c.fields = append(c.fields, c.h.prefields...)
+		if r.NumAttrs() > 0 {
+			r.Attrs(c.walkAttrs)
+		}
+		c.appendFields()
+	default:
+		// write preformatted
+		c.addSpace(c.bufLen() > 0 && len(c.h.preformatted) > 0)
+		c.buf.write(c.h.preformatted)
+		c.optionalFlush()
+		// write record attributes
+		if r.NumAttrs() > 0 {
+			r.Attrs(c.walkAttrs)
+		}
+	}
+}
+
+func (c *composer) appendAttr(a slog.Attr, keyPref string) {
 	// Resolve the Attr's value before doing anything else.
 	a.Value = a.Value.Resolve()
+	a = c.optionalReplaceAttr(c.groups(), a)
 	// Ignore empty Attrs.
 	if a.Equal(slog.Attr{}) {
 		return
 	}
 
+	if a.Value.Kind() != slog.KindGroup && !c.includeAttr(a) {
+		return
+	}
+
 	if len(keyPref) == 0 {
 		keyPref = string(c.h.prefix)
 	}
 
+	a.Key = c.optionalKeyTransform(a.Key)
+
 	switch a.Value.Kind() {
 	case slog.KindGroup:
 		attrs := a.Value.Group()
@@ -89,42 +332,491 @@ func (c *composer) appendAttr(a slog.Attr, keyPref string) {
 			return
 		}
 
+		c.pushGroup(a.Key)
 		for _, ga := range attrs {
-			c.appendAttr(ga, mergePrefWithKey(keyPref, a.Key))
+			c.appendAttr(ga, mergePrefWithKey(keyPref, c.h.groupName(a.Key)))
 		}
+		c.popGroup(a.Key)
 
 	default:
-		c.addSpace(c.bufLen() > 0)
-		c.buf.writeString(mergePrefWithKey(keyPref, a.Key))
-		c.buf.writeByte('=')
-		*c.buf = appendValue(a.Value, *c.buf)
+		key := mergePrefWithKey(keyPref, a.Key)
+		outKey := key
+		if c.h.opts.MaxGroupPrefixSegments > 0 {
+			outKey = mergePrefWithKey(collapsePrefix(keyPref, c.h.opts.MaxGroupPrefixSegments), a.Key)
+		}
+
+		if c.h.opts.OnKeyCollision != KeyCollisionKeep && slices.Contains(c.reserved, outKey) {
+			if c.h.opts.OnKeyCollision == KeyCollisionSkip {
+				return
+			}
+			outKey += keyCollisionSuffix
+		}
+
+		c.appendKeyValue(key, outKey, a.Value)
+	}
+}
+
+// appendKeyValue writes key=value, outKey is the printed key
+func (c *composer) appendKeyValue(key, outKey string, v slog.Value) {
+	if c.collect {
+		start := c.bufLen()
+		if c.h.opts.Format == FormatJSON {
+			*c.buf = appendJSONValue(v, *c.buf)
+		} else {
+			c.appendColoredValue(key, v)
+			c.appendDelta(key, v)
+		}
+
+		f := field{key: outKey, val: string((*c.buf)[start:])}
+		if c.h.opts.GroupBlocks || c.h.opts.SortAttrs == SortGrouped {
+			var rest string
+			if f.group, rest = c.splitTopGroup(outKey); c.h.opts.GroupBlocks {
+				f.key = rest
+			}
+		}
+		c.fields = append(c.fields, f)
+		*c.buf = (*c.buf)[:start]
+		return
+	}
+
+	if c.h.opts.Format == FormatJSON {
+		c.appendJSONField(outKey, v)
+		return
 	}
+
+	c.addSpace(c.bufLen() > 0)
+	c.appendKey(outKey)
+	c.buf.writeString(c.h.opts.KVSeparator)
+	c.appendColoredValue(key, v)
+	c.appendDelta(key, v)
+}
+
+// appendKey writes the key in Options.KeyColor if Colorize is on
+func (c *composer) appendKey(key string) {
+	if len(c.h.opts.KeyColor) == 0 || !c.h.ColorEnabled() {
+		c.buf.writeString(key)
+		return
+	}
+
+	c.buf.writeString(c.h.opts.KeyColor)
+	c.buf.writeString(key)
+	c.appendColorReset()
+}
+
+// appendColoredValue writes the value with the unit in Options.ValueColor if Colorize is on
+func (c *composer) appendColoredValue(key string, v slog.Value) {
+	color := len(c.h.opts.ValueColor) > 0 && c.h.ColorEnabled()
+	if color {
+		c.buf.writeString(c.h.opts.ValueColor)
+	}
+	c.appendValue(v)
+	c.buf.writeString(c.h.opts.UnitKeys[key])
+	if color {
+		c.appendColorReset()
+	}
+}
+
+// splitTopGroup splits the key of the grouped attribute to the top-level group and the rest
+func (c *composer) splitTopGroup(key string) (string, string) {
+	var g string
+	switch {
+	case len(c.h.groups) > 0:
+		g = c.h.groupName(c.h.groups[0])
+	case len(c.nested) > 0:
+		g = c.h.groupName(c.nested[0])
+	default:
+		return "", key
+	}
+
+	if rest, ok := strings.CutPrefix(key, g+"."); ok {
+		return g, rest
+	}
+	return "", key
+}
+
+// appendFields writes collected fields. Fields are written one per line with
+// aligned "=" if Options.MultiLine is on, otherwise on the same line.
+// If Options.GroupBlocks is on, grouped fields follow in blocks per top-level group
+func (c *composer) appendFields() {
+	c.arrangeFields()
+
+	if !c.h.opts.GroupBlocks {
+		c.appendFieldRun(c.fields)
+		return
+	}
+
+	// ungrouped fields go first, then blocks in the order of the first attribute
+	for _, f := range c.fields {
+		if len(f.group) > 0 && !slices.Contains(c.blocks, f.group) {
+			c.blocks = append(c.blocks, f.group)
+		}
+	}
+	slices.SortStableFunc(c.fields, func(a, b field) int {
+		return slices.Index(c.blocks, a.group) - slices.Index(c.blocks, b.group)
+	})
+
+	for i := 0; i < len(c.fields); {
+		g := c.fields[i].group
+		j := i + 1
+		for j < len(c.fields) && c.fields[j].group == g {
+			j++
+		}
+
+		if len(g) == 0 {
+			c.appendFieldRun(c.fields[i:j])
+		} else {
+			c.appendNewLine()
+			c.buf.writeString(g)
+			c.buf.writeByte(':')
+			c.appendFieldLines(c.fields[i:j], multiLineIndent)
+		}
+		i = j
+	}
+}
+
+// arrangeFields applies Options.DedupKeys and Options.SortAttrs to the fields
+func (c *composer) arrangeFields() {
+	if c.h.opts.DedupKeys {
+		c.dedupFields()
+	}
+	c.sortFields()
+}
+
+// dedupFields drops the fields whose key is repeated later, see Options.DedupKeys
+func (c *composer) dedupFields() {
+	if c.seen == nil {
+		c.seen = make(map[[2]string]struct{})
+	}
+
+	// the last ones are kept, they go to the tail in the same order
+	n := len(c.fields)
+	for i := len(c.fields) - 1; i >= 0; i-- {
+		f := c.fields[i]
+		k := [2]string{f.group, f.key}
+		if _, ok := c.seen[k]; ok {
+			continue
+		}
+		c.seen[k] = struct{}{}
+		n--
+		c.fields[n] = f
+	}
+	c.fields = append(c.fields[:0], c.fields[n:]...)
+	clear(c.seen)
+}
+
+// sortFields orders fields according to Options.SortAttrs
+func (c *composer) sortFields() {
+	switch c.h.opts.SortAttrs {
+	case SortKeys:
+		slices.SortStableFunc(c.fields, func(a, b field) int {
+			return strings.Compare(a.key, b.key)
+		})
+	case SortGrouped:
+		slices.SortStableFunc(c.fields, func(a, b field) int {
+			if n := strings.Compare(a.top(), b.top()); n != 0 {
+				return n
+			}
+			return strings.Compare(a.key, b.key)
+		})
+	}
+}
+
+// appendFieldRun writes ungrouped fields one per line if Options.MultiLine is
+// on, otherwise on the same line
+func (c *composer) appendFieldRun(fields []field) {
+	if c.h.opts.MultiLine {
+		c.appendFieldLines(fields, "")
+		return
+	}
+
+	keyWidth := 0
+	if c.h.opts.AlignAttrs {
+		for _, f := range fields {
+			keyWidth = max(keyWidth, visibleLen(f.key))
+		}
+	}
+
+	width := c.h.Width()
+	col := 0
+	if width > 0 {
+		col = VisibleLen((*c.buf)[bytes.LastIndexByte(*c.buf, '\n')+1:])
+	}
+	sepLen, kvLen := visibleLen(c.h.opts.FieldSeparator), visibleLen(c.h.opts.KVSeparator)
+
+	for _, f := range fields {
+		if width > 0 {
+			// wrap before the field going past the width
+			n := max(visibleLen(f.key), keyWidth) + kvLen + visibleLen(f.val)
+			if col > 0 && col+sepLen+n > width {
+				c.appendNewLine()
+				col = visibleLen(*c.h.opts.ContinuationPrefix)
+			} else if col > 0 {
+				c.addSpace(true)
+				col += sepLen
+			}
+			col += n
+		} else {
+			c.addSpace(c.bufLen() > 0)
+		}
+
+		c.appendKey(f.key)
+		for n := visibleLen(f.key); n < keyWidth; n++ {
+			c.buf.writeByte(' ')
+		}
+		c.buf.writeString(c.h.opts.KVSeparator)
+		c.buf.writeString(f.val)
+	}
+}
+
+// appendNewLine starts the continuation line
+func (c *composer) appendNewLine() {
+	c.buf.writeByte('\n')
+	c.buf.writeString(*c.h.opts.ContinuationPrefix)
+}
+
+// appendFieldLines writes fields one per line with aligned "=",
+// indent goes after Options.ContinuationPrefix
+func (c *composer) appendFieldLines(fields []field, indent string) {
+	width := 0
+	for _, f := range fields {
+		width = max(width, visibleLen(f.key))
+	}
+
+	for _, f := range fields {
+		c.appendNewLine()
+		c.buf.writeString(indent)
+		c.appendKey(f.key)
+		for n := visibleLen(f.key); n < width; n++ {
+			c.buf.writeByte(' ')
+		}
+		c.buf.writeString(c.h.opts.KVSeparator)
+		c.buf.writeString(f.val)
+	}
+}
+
+var newlineEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+
+func (c *composer) appendValue(v slog.Value) {
+	if c.h.opts.OnUnknownKind != nil && !knownKind(v.Kind()) {
+		c.h.opts.OnUnknownKind(v)
+	}
+
+	if v.Kind() == slog.KindString {
+		c.appendString(v.String())
+		return
+	}
+
+	if c.h.opts.Format == FormatLogfmt {
+		c.appendLogfmtValue(v)
+		return
+	}
+
+	if c.h.opts.ColorBooleans && c.h.ColorEnabled() {
+		if color, ok := booleanColor(v); ok {
+			c.buf.writeString(color)
+			*c.buf = appendValue(v, *c.buf)
+			c.appendColorReset()
+			return
+		}
+	}
+
+	if v.Kind() == slog.KindTime {
+		*c.buf = v.Time().AppendFormat(*c.buf, c.h.opts.AttrTimeFormat)
+		return
+	}
+
+	if c.h.opts.ExpandSlices && v.Kind() == slog.KindAny {
+		var ok bool
+		if *c.buf, ok = appendSlice(v, *c.buf, c.h.opts.AttrTimeFormat, c.appendStringTo); ok {
+			return
+		}
+	}
+
+	*c.buf = appendValue(v, *c.buf)
+}
+
+// appendString writes the string value, quoted if Options.QuoteAllStrings
+// is on or the string needs it
+func (c *composer) appendString(str string) {
+	*c.buf = c.appendStringTo(*c.buf, str)
+}
+
+// appendStringTo is appendString to dst, it is used for the slice elements
+func (c *composer) appendStringTo(dst []byte, str string) []byte {
+	switch {
+	case c.h.opts.QuoteAllStrings:
+		return strconv.AppendQuote(dst, str)
+	case c.h.opts.EscapeNewlinesInValues:
+		// quoting escapes newlines as well
+		if esc := newlineEscaper.Replace(str); !c.needsQuoting(esc) {
+			return append(dst, esc...)
+		}
+	}
+
+	if c.needsQuoting(str) {
+		return strconv.AppendQuote(dst, str)
+	}
+	return append(dst, str...)
+}
+
+// needsQuoting reports whether the string value is quoted, see Options.NeedsQuoting
+func (c *composer) needsQuoting(s string) bool {
+	if c.h.opts.NeedsQuoting != nil {
+		return c.h.opts.NeedsQuoting(s)
+	}
+	return needsQuoting(s)
+}
+
+// appendTemplateValue writes v into the message, strings are not quoted
+func (c *composer) appendTemplateValue(v slog.Value) {
+	if v.Kind() == slog.KindString {
+		c.buf.writeString(v.String())
+		return
+	}
+	c.appendValue(v)
+}
+
+func (c *composer) appendDelta(key string, v slog.Value) {
+	if c.deltas == nil {
+		return
+	}
+
+	var d time.Duration
+	switch v.Kind() {
+	case slog.KindDuration:
+		prev, ok := c.deltas.swap(key, v)
+		if !ok || prev.Kind() != slog.KindDuration {
+			return
+		}
+		d = v.Duration() - prev.Duration()
+	case slog.KindTime:
+		prev, ok := c.deltas.swap(key, v)
+		if !ok || prev.Kind() != slog.KindTime {
+			return
+		}
+		d = v.Time().Sub(prev.Time())
+	default:
+		return
+	}
+
+	c.buf.writeString(c.h.opts.FieldSeparator)
+	c.buf.writeByte('(')
+	if d >= 0 {
+		c.buf.writeByte('+')
+	}
+	c.buf.writeString(d.String())
+	c.buf.writeByte(')')
 }
 
 func (c *composer) appendLevel(lv slog.Level) {
-	lvStr := c.optionalStringLevel(lv)
+	if len(c.levelKey) == 0 {
+		return
+	}
+
+	color := c.h.ColorEnabled()
+	lvStr := c.levelText
+	if len(lvStr) == 0 {
+		lvStr = c.optionalStringLevel(lv, color)
+	}
 
-	color := c.h.opts.Colorize.Bool() && runtime.GOOS != "windows"
-	if !color {
-		c.addSpace(len(*c.buf) > 0)
+	c.addSpace(len(*c.buf) > 0)
+	c.buf.writeString(c.h.opts.LevelPrefix[lv])
+	if c.h.opts.LevelBadge {
+		c.appendBadge(lv, lvStr, color)
+		return
+	}
+	// the whole line has the color already
+	if !color || len(c.lineColor) > 0 {
 		c.buf.writeString(lvStr)
+		c.appendLevelPadding(lvStr)
 		return
 	}
 
-	c.addSpace(len(*c.buf) > 0)
+	if c.h.opts.BoldLevel {
+		c.buf.writeString(ConsoleBold)
+	}
+	c.buf.writeString(c.h.levelColor(lv))
+	c.buf.writeString(lvStr)
+	c.appendLevelPadding(lvStr)
+	c.buf.writeString(c.h.opts.ColorReset)
+}
+
+// appendLevelPadding writes trailing spaces up to Options.LevelWidth
+func (c *composer) appendLevelPadding(lvStr string) {
+	if c.h.opts.LevelWidth <= 0 {
+		return
+	}
 
+	for n := visibleLen(lvStr); n < c.h.opts.LevelWidth; n++ {
+		c.buf.writeByte(' ')
+	}
+}
+
+// levelColor returns the palette color of the level
+func (h *ConsoleHandler) levelColor(lv slog.Level) string {
+	pl := h.opts.Palette.Palette()
 	switch {
 	case lv < slog.LevelInfo:
-		c.buf.writeString(ConsoleColorWhite)
+		return pl.Debug
 	case lv < slog.LevelWarn:
-		c.buf.writeString(ConsoleColorGreen)
+		return pl.Info
 	case lv < slog.LevelError:
-		c.buf.writeString(ConsoleColorYellow)
+		return pl.Warn
 	default:
-		c.buf.writeString(ConsoleColorRed)
+		return pl.Error
 	}
+}
 
-	c.buf.writeString(lvStr + ConsoleColorReset)
+// appendColorReset closes the colorized text inside of the line,
+// the Options.ColorizeLine color goes on
+func (c *composer) appendColorReset() {
+	c.buf.writeString(c.h.opts.ColorReset)
+	c.buf.writeString(c.lineColor)
+}
+
+// optionalLineColor inserts the Options.ColorizeLine color before the line
+// once, so the separators of the composed parts are not affected
+func (c *composer) optionalLineColor() {
+	if len(c.lineColor) == 0 || c.lineColored {
+		return
+	}
+	c.lineColored = true
+
+	n := c.bufLen()
+	c.buf.writeString(c.lineColor)
+	copy((*c.buf)[len(c.lineColor):], (*c.buf)[:n])
+	copy(*c.buf, c.lineColor)
+	if c.stamp.end > 0 {
+		c.stamp.start += len(c.lineColor)
+		c.stamp.end += len(c.lineColor)
+	}
+}
+
+// appendBadge writes the "level" word padded with spaces on the background color
+func (c *composer) appendBadge(lv slog.Level, lvStr string, color bool) {
+	if color {
+		switch {
+		case lv < slog.LevelInfo:
+			c.buf.writeString(ConsoleBgWhite)
+		case lv < slog.LevelWarn:
+			c.buf.writeString(ConsoleBgGreen)
+		case lv < slog.LevelError:
+			c.buf.writeString(ConsoleBgYellow)
+		default:
+			c.buf.writeString(ConsoleBgRed)
+		}
+	}
+
+	c.buf.writeByte(' ')
+	c.buf.writeString(lvStr)
+	for n := visibleLen(lvStr); n < badgeWidth; n++ {
+		c.buf.writeByte(' ')
+	}
+	c.buf.writeByte(' ')
+
+	if color {
+		c.appendColorReset()
+	}
 }
 
 func (c *composer) appendTime(tm time.Time) {
@@ -132,23 +824,168 @@ func (c *composer) appendTime(tm time.Time) {
 		return
 	}
 
+	c.addSpace(c.bufLen() > 0)
+
+	// the whole line has the color already
+	color := len(c.lineColor) == 0 && c.h.ColorEnabled()
+	if color {
+		c.buf.writeString(c.h.opts.TimeColor)
+	}
+
+	if len(c.timeText) > 0 {
+		c.buf.writeString(c.timeText)
+	} else {
+		c.appendTimeValue(tm)
+	}
+
+	if color {
+		c.buf.writeString(c.h.opts.ColorReset)
+	}
+}
+
+// appendTimeValue writes the record time according to the time options
+func (c *composer) appendTimeValue(tm time.Time) {
+	switch {
+	case c.h.opts.ElapsedTime:
+		c.appendElapsed(tm.Sub(c.h.start))
+	case c.h.opts.UnixTime:
+		c.appendUnixTime(tm)
+	default:
+		c.appendTimeFormat(tm)
+	}
+}
+
+// appendElapsed writes d in seconds with milliseconds, e.g. "+1.234s"
+func (c *composer) appendElapsed(d time.Duration) {
+	if d >= 0 {
+		c.buf.writeByte('+')
+	}
+	*c.buf = strconv.AppendFloat(*c.buf, d.Seconds(), 'f', 3, 64)
+	c.buf.writeByte('s')
+}
+
+// appendUnixTime writes seconds since epoch with milliseconds, e.g. "1694376000.123"
+func (c *composer) appendUnixTime(tm time.Time) {
+	ms := tm.UnixMilli()
+	if ms < 0 {
+		c.buf.writeByte('-')
+		ms = -ms
+	}
+
+	*c.buf = strconv.AppendInt(*c.buf, ms/1000, 10)
+	ms %= 1000
+	*c.buf = append(*c.buf, '.', byte('0'+ms/100), byte('0'+ms/10%10), byte('0'+ms%10))
+}
+
+func (c *composer) appendTimeFormat(tm time.Time) {
+	if c.h.opts.UTC {
+		tm = tm.UTC()
+	}
+
+	start := c.bufLen()
 	*c.buf = tm.AppendFormat(*c.buf, c.h.opts.TimeFormat)
+	if c.h.opts.SubSecondOnly {
+		// the second is compared in the write order
+		c.stamp = stamp{tm: tm, start: start, end: c.bufLen()}
+	}
+}
+
+// stamp is the position of the full timestamp in the line, it is replaced
+// with the sub-second one under the mutex, see Options.SubSecondOnly
+type stamp struct {
+	tm         time.Time
+	start, end int
 }
 
 func (c *composer) bufLen() int {
 	return len(*c.buf)
 }
 
-func (c *composer) optionalStringLevel(lv slog.Level) (v string) {
-	if c.h.opts.StringLevel != nil {
+func (c *composer) optionalStringLevel(lv slog.Level, colored bool) (v string) {
+	if c.h.opts.StringLevelFunc != nil {
+		v = c.h.opts.StringLevelFunc(lv, colored)
+	} else if c.h.opts.StringLevel != nil {
 		v = c.h.opts.StringLevel(lv)
 	} else {
-		v = lv.String()
+		name := lv.String()
+		if c.h.opts.ExtendedLevels {
+			name = extendedLevelName(lv)
+		}
+		if c.h.opts.AbbreviatedLevels {
+			name = abbreviateLevel(name)
+		}
+		v = c.h.opts.LevelFormat.format(name, lv)
 	}
 
 	return
 }
 
+// abbreviateLevel shortens the level name at the start of s to three letters,
+// the offset is kept, e.g. "ERROR+4" is "ERR+4"
+func abbreviateLevel(s string) string {
+	for _, v := range [...][2]string{
+		{"DEBUG", "DBG"},
+		{"INFO", "INF"},
+		{"WARN", "WRN"},
+		{"ERROR", "ERR"},
+		{"TRACE", "TRC"},
+		{"FATAL", "FTL"},
+	} {
+		if rest, ok := strings.CutPrefix(s, v[0]); ok {
+			return v[1] + rest
+		}
+	}
+
+	return s
+}
+
+func (c *composer) pushGroup(name string) {
+	if len(name) > 0 {
+		c.nested = append(c.nested, name)
+	}
+}
+
+func (c *composer) popGroup(name string) {
+	if len(name) > 0 {
+		c.nested = c.nested[:len(c.nested)-1]
+	}
+}
+
+// includeAttr reports whether the non-group attribute passes Options.IncludeAttr
+func (c *composer) includeAttr(a slog.Attr) bool {
+	if c.h.opts.IncludeAttr == nil {
+		return true
+	}
+
+	groups := c.h.groups
+	if len(c.nested) > 0 {
+		groups = make([]string, 0, len(c.h.groups)+len(c.nested))
+		groups = append(groups, c.h.groups...)
+		groups = append(groups, c.nested...)
+	}
+
+	return c.h.opts.IncludeAttr(groups, a)
+}
+
+func (c *composer) optionalKeyTransform(key string) string {
+	if c.h.opts.KeyTransform == nil || len(key) == 0 {
+		return key
+	}
+
+	return c.h.opts.KeyTransform(key)
+}
+
+// groups returns the groups of WithGroup and the group attributes
+// containing the attribute being written
+func (c *composer) groups() []string {
+	if len(c.nested) == 0 {
+		return c.h.groups
+	}
+
+	c.groupPath = append(append(c.groupPath[:0], c.h.groups...), c.nested...)
+	return c.groupPath
+}
+
 func (c *composer) optionalReplaceAttr(groups []string, a slog.Attr) slog.Attr {
 	if c.h.opts.ReplaceAttr == nil {
 		return a
@@ -158,21 +995,167 @@ func (c *composer) optionalReplaceAttr(groups []string, a slog.Attr) slog.Attr {
 	return na
 }
 
+// replaceBuiltins calls Options.ReplaceAttr for the time, level and message
+// of the record with nil groups, as slog handlers do. The returned record has
+// the replaced values of the same kind, the values of other kinds are written
+// as text. The attribute with the empty key drops the field
+func (c *composer) replaceBuiltins(r slog.Record) slog.Record {
+	rep := c.h.opts.ReplaceAttr
+
+	if !r.Time.IsZero() {
+		a := rep(nil, slog.Time(slog.TimeKey, r.Time))
+		a.Value = a.Value.Resolve()
+		switch c.timeKey = a.Key; {
+		case len(a.Key) == 0:
+			r.Time = time.Time{}
+		case a.Value.Kind() == slog.KindTime:
+			r.Time = a.Value.Time()
+		default:
+			c.timeText = a.Value.String()
+		}
+	}
+
+	if !c.h.opts.DropLevel {
+		a := rep(nil, slog.Any(slog.LevelKey, r.Level))
+		a.Value = a.Value.Resolve()
+		c.levelKey = a.Key
+		if lv, ok := a.Value.Any().(slog.Level); ok && a.Value.Kind() == slog.KindAny {
+			r.Level = lv
+		} else if len(a.Key) > 0 {
+			c.levelText = a.Value.String()
+		}
+	}
+
+	a := rep(nil, slog.String(slog.MessageKey, r.Message))
+	c.msgKey = a.Key
+	r.Message = ""
+	if len(a.Key) > 0 {
+		r.Message = a.Value.Resolve().String()
+	}
+
+	return r
+}
+
 func (c *composer) appendSource(pc uintptr) {
-	if !c.h.opts.AddSource || pc != 0 {
+	if !c.h.opts.AddSource || pc == 0 {
 		return
 	}
 
+	// top-level built-in field, ReplaceAttr gets nil groups as for the time
+	a := c.optionalReplaceAttr(nil, slog.String(slog.SourceKey, c.h.source(pc)))
+	if len(a.Key) == 0 {
+		return
+	}
+	c.appendKeyValue(a.Key, a.Key, a.Value.Resolve())
+	c.reserved = append(c.reserved, a.Key)
+}
+
+// reserveStatic reserves the keys of the fields written by every record, so
+// the attributes of WithAttrs collide with them as the record ones do.
+// The keys renamed by Options.ReplaceAttr aren't known in advance
+func (c *composer) reserveStatic() {
+	if c.h.opts.Format != FormatText {
+		if !c.h.opts.DropTime {
+			c.reserved = append(c.reserved, c.timeKey)
+		}
+		if len(c.levelKey) > 0 {
+			c.reserved = append(c.reserved, c.levelKey)
+		}
+		c.reserved = append(c.reserved, c.msgKey)
+	}
+	if c.h.opts.AddSource {
+		c.reserved = append(c.reserved, slog.SourceKey)
+	}
+}
+
+// source returns the formatted source of pc from the cache
+func (h *ConsoleHandler) source(pc uintptr) string {
+	src, ok := h.sources.get(pc)
+	if !ok {
+		src = h.formatSource(pc)
+		h.sources.put(pc, src)
+	}
+
+	return src
+}
+
+// formatSource returns the file:line of pc according to the source options
+func (h *ConsoleHandler) formatSource(pc uintptr) string {
 	fs := runtime.CallersFrames([]uintptr{pc})
 	f, _ := fs.Next()
-	c.appendAttr(slog.String(slog.SourceKey, fmt.Sprintf("%s=%d", f.File, f.Line)), c.pref)
+
+	file := trimSourcePrefix(f.File, h.opts.SourceTrimPrefix)
+	if h.opts.ShortSource {
+		file = filepath.Base(file)
+	}
+	src := file + ":" + strconv.Itoa(f.Line)
+	if h.opts.SourceFunction && len(f.Function) > 0 {
+		src = f.Function + " (" + src + ")"
+	}
+
+	return src
+}
+
+// trimSourcePrefix removes the directory prefix from the file path,
+// "/a/b" is not the prefix of "/a/bc/x.go"
+func trimSourcePrefix(file, prefix string) string {
+	if len(prefix) == 0 {
+		return file
+	}
+
+	rel, ok := strings.CutPrefix(file, prefix)
+	if !ok || !strings.HasSuffix(prefix, "/") && !strings.HasPrefix(rel, "/") {
+		return file
+	}
+	return strings.TrimLeft(rel, "/")
 }
 
 func (c *composer) walkAttrs(a slog.Attr) bool {
 	c.appendAttr(a, c.pref)
+	c.optionalFlush()
 	return true
 }
 
+// optionalFlush writes the buffer to the Options.Streaming writer once it grows to
+// the chunk size. The last byte is kept, so the separators are written as usual.
+// After the write error the chunks are dropped
+func (c *composer) optionalFlush() {
+	if !c.streaming || c.bufLen() < streamChunkSize {
+		return
+	}
+
+	c.lockStream()
+	c.optionalLineColor()
+	last := c.bufLen() - 1
+	if c.streamErr == nil {
+		n, err := c.stream.Write((*c.buf)[:last])
+		c.streamErr = err
+		c.rotate = c.h.countWritten(n) || c.rotate
+	}
+	(*c.buf)[0] = (*c.buf)[last]
+	*c.buf = (*c.buf)[:1]
+}
+
+// lockStream locks the mutex for the rest of the streamed record, the chunks
+// of records don't interleave
+func (c *composer) lockStream() {
+	if c.stream == nil {
+		c.h.mu.Lock()
+		c.stream = c.h.writer(c.streamLevel)
+		// the timestamp goes with the first chunk
+		c.h.stampLocked(c.stream, c.buf, c.stamp)
+		c.stamp = stamp{}
+	}
+}
+
+// unlockStream unlocks the mutex if lockStream locked it
+func (c *composer) unlockStream() {
+	if c.stream != nil {
+		c.stream = nil
+		c.h.mu.Unlock()
+	}
+}
+
 // Copied from encoding/json/tables.go.
 //
 // safeSet holds the value true if the ASCII character with the given array
@@ -0,0 +1,115 @@
+package slogconsole
+
+import (
+	"bytes"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+var fuzzSeeds = []string{
+	"",
+	testString,
+	testMessage,
+	testError.Error(),
+	"GET",
+	`C:\path`,
+	"a=b",
+	`a"b`,
+	"a\nb",
+	"a\x00b",
+	"a\x7fb",
+	"привет",
+	"abc\u00a0def",
+	"abc\u200bdef",
+	"abc\xffdef",
+	"\033[31mred\033[0m",
+}
+
+// checkPlain fails if the unquoted value can't be told apart from the
+// neighbour tokens
+func checkPlain(t *testing.T, s string) {
+	t.Helper()
+	if !utf8.ValidString(s) {
+		t.Fatalf("invalid UTF-8 in %q", s)
+	}
+	for _, r := range s {
+		if r == ' ' || r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			t.Fatalf("unquoted %q in %q", r, s)
+		}
+	}
+}
+
+func FuzzAppendString(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		got := string(appendString(nil, s))
+		if !needsQuoting(s) {
+			if got != s {
+				t.Fatalf("got %q, want %q", got, s)
+			}
+			checkPlain(t, got)
+			return
+		}
+
+		u, err := strconv.Unquote(got)
+		if err != nil {
+			t.Fatalf("unquote %q: %v", got, err)
+		}
+		if u != s {
+			t.Fatalf("round trip got %q, want %q", u, s)
+		}
+	})
+}
+
+func FuzzConsoleTextHandler(f *testing.F) {
+	for _, s := range fuzzSeeds {
+		f.Add(s)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	logger := slog.New(New(buf, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+	}))
+
+	f.Fuzz(func(t *testing.T, s string) {
+		buf.Reset()
+		logger.Info("msg",
+			slog.String("str", s),
+			slog.Any("err", testErrorString(s)),
+			slog.Group("grp", slog.String("str", s)),
+		)
+
+		got := buf.String()
+		if !strings.HasSuffix(got, "\n") {
+			t.Fatalf("missing line end in %q", got)
+		}
+		got = got[:len(got)-1]
+		if strings.ContainsAny(got, "\n\r\033") {
+			t.Fatalf("raw control character in %q", got)
+		}
+
+		r, err := ParseLine(got, &Options{DropTime: true})
+		if err != nil {
+			t.Fatalf("parse %q: %v", got, err)
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key != "str" || a.Value.String() != s {
+				t.Fatalf("got first attr %v, want str=%q in %q", a, s, got)
+			}
+			return false
+		})
+	})
+}
+
+// testErrorString is an error with the given text
+type testErrorString string
+
+func (e testErrorString) Error() string { return string(e) }
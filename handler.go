@@ -2,11 +2,18 @@ package slogconsole
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"log/slog"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -21,8 +28,40 @@ const (
 	ConsoleColorCyan   = "\033[36m"
 	ConsoleColorGray   = "\033[37m"
 	ConsoleColorWhite  = "\033[97m"
+	// dim gray
+	ConsoleColorDarkGray = "\033[90m"
+	// default terminal color
+	ConsoleColorDefault = "\033[39m"
+	// bold text, combined with a color
+	ConsoleBold = "\033[1m"
+
+	ConsoleBgRed    = "\033[41m"
+	ConsoleBgGreen  = "\033[42m"
+	ConsoleBgYellow = "\033[43m"
+	ConsoleBgWhite  = "\033[47m"
 )
 
+// osExit is called on Options.ExitLevel records, tests replace it
+var osExit = os.Exit
+
+// timeNow is the clock of Options.ElapsedTime, tests replace it
+var timeNow = time.Now
+
+// consoleVT turns on the escape sequences processing, tests replace it
+var consoleVT = enableVT
+
+// Color256 returns the escape sequence of the foreground color n of the
+// 256-color terminal palette
+func Color256(n uint8) string {
+	return "\033[38;5;" + strconv.Itoa(int(n)) + "m"
+}
+
+// RGB returns the escape sequence of the 24-bit foreground color
+// of the truecolor terminal
+func RGB(r, g, b uint8) string {
+	return "\033[38;2;" + strconv.Itoa(int(r)) + ";" + strconv.Itoa(int(g)) + ";" + strconv.Itoa(int(b)) + "m"
+}
+
 func appendString(dst []byte, str string) []byte {
 	if needsQuoting(str) {
 		return strconv.AppendQuote(dst, str)
@@ -36,10 +75,85 @@ type ConsoleHandler struct {
 
 	groups       []string
 	preformatted []byte
+	prefields    []field
 	prefix       string
+	// number of groups opened in the preformatted, see Options.AttrsAsJSON
+	openGroups int
+
+	mu *sync.Mutex
+	// shared with derived handlers. Guarded by mu
+	out *output
+	// set if Options.Colorize is nil, follows the writer
+	autoColor *BoolVar
+
+	// rolling line digest, see Options.HashChain. Guarded by mu
+	chain *[sha256.Size]byte
+	// previous values of Options.DeltaKeys
+	deltas *deltaState
+	// queue of the lines to write, see Options.AsyncWrite
+	async *asyncWriter
+	// formatted sources, see Options.SourceCacheSize
+	sources *sourceCache
+	// terminal width if Options.AutoWidth is on, follows the writer
+	width *atomic.Int64
+	// the writer processes the escape sequences, follows the writer
+	vt *vtState
+	// FORCE_COLOR environment variable is set
+	forceColor bool
+	// creation time of the handler, see Options.ElapsedTime
+	start time.Time
+	// parsed Options.Template
+	layout []layoutPart
+	// level of SetLevel if Options.Level is not *slog.LevelVar
+	levelSet *atomic.Pointer[slog.Level]
+}
+
+type output struct {
+	w io.Writer
+	// writer of the error and higher levels if set, see NewSplit
+	errW io.Writer
+	// bytes written, see Options.MaxTotalBytes
+	written int64
+	// unix second of the last timestamp written to the writer, a writer
+	// without a timestamp yet is absent, see Options.SubSecondOnly
+	secs map[io.Writer]int64
+}
 
-	mu  *sync.Mutex
-	out io.Writer
+type deltaState struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+	last map[string]slog.Value
+}
+
+func newDeltaState(keys []string) *deltaState {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ds := &deltaState{
+		keys: make(map[string]struct{}, len(keys)),
+		last: make(map[string]slog.Value, len(keys)),
+	}
+	for _, k := range keys {
+		ds.keys[k] = struct{}{}
+	}
+
+	return ds
+}
+
+// swap stores v as the last value of the key and returns the previous one
+func (ds *deltaState) swap(key string, v slog.Value) (prev slog.Value, ok bool) {
+	if _, ok = ds.keys[key]; !ok {
+		return
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	prev, ok = ds.last[key]
+	ds.last[key] = v
+
+	return
 }
 
 // New creates a ConsoleHandler that writes to w, using the given options.
@@ -49,71 +163,501 @@ func New(w io.Writer, opts *Options) (h *ConsoleHandler) {
 		opts = &Options{}
 	}
 
+	if w == nil {
+		w = os.Stderr
+	}
+
 	h = &ConsoleHandler{
 		opts: *opts,
 		mu:   new(sync.Mutex),
-		out:  w,
+
+		chain:   new([sha256.Size]byte),
+		deltas:  newDeltaState(opts.DeltaKeys),
+		sources: newSourceCache(opts.SourceCacheSize),
+
+		forceColor: len(os.Getenv("NO_COLOR")) == 0 && forceColor(),
+		start:      timeNow(),
+		levelSet:   new(atomic.Pointer[slog.Level]),
 	}
 	// defaults
 	h.opts.Level = optionalLevelVar(h.opts.Level)
+	switch h.opts.ColorMode {
+	case ColorAlways, ColorNever:
+		colorize := new(BoolVar)
+		colorize.Set(h.opts.ColorMode == ColorAlways)
+		h.opts.Colorize = colorize
+	case ColorAuto:
+		h.opts.Colorize = nil
+	}
 	if h.opts.Colorize == nil {
-		h.opts.Colorize = new(BoolVar)
+		h.autoColor = new(BoolVar)
+		h.autoColor.Set(detectColor(w))
+		h.opts.Colorize = h.autoColor
+	}
+	if h.opts.Palette == nil {
+		pl := new(PaletteVar)
+		if h.opts.Colors != nil {
+			pl.Set(*h.opts.Colors)
+		}
+		h.opts.Palette = pl
+	}
+	if len(h.opts.ColorReset) == 0 {
+		h.opts.ColorReset = ConsoleColorReset
+	}
+	if len(h.opts.TimeColor) == 0 {
+		h.opts.TimeColor = ConsoleColorDarkGray
 	}
 	if len(h.opts.TimeFormat) == 0 {
 		h.opts.TimeFormat = defaultTimeFormat
+		if h.opts.Format == FormatLogfmt {
+			h.opts.TimeFormat = logfmtTimeFormat
+		}
+	}
+	if len(h.opts.RequestIDAttr) == 0 {
+		h.opts.RequestIDAttr = defaultRequestIDAttr
+	}
+	if len(h.opts.AttrTimeFormat) == 0 {
+		h.opts.AttrTimeFormat = h.opts.TimeFormat
+	}
+	if h.opts.EscapeMessageNewlines == nil {
+		h.opts.EscapeMessageNewlines = constBool(true)
+	}
+	// copy, the handler doesn't follow changes of the option
+	prefix := multiLineIndent
+	if h.opts.ContinuationPrefix != nil {
+		prefix = *h.opts.ContinuationPrefix
+	}
+	h.opts.ContinuationPrefix = &prefix
+	if len(h.opts.FieldSeparator) == 0 {
+		h.opts.FieldSeparator = defaultFieldSeparator
+	}
+	if len(h.opts.KVSeparator) == 0 {
+		h.opts.KVSeparator = defaultKVSeparator
+	}
+
+	if len(h.opts.Template) > 0 {
+		// the default layout is kept on the invalid template
+		if layout, err := parseLayout(h.opts.Template); err == nil {
+			h.layout = layout
+		}
+	}
+
+	switch h.opts.Format {
+	case FormatJSON:
+		h.opts = jsonOptions(h.opts)
+	case FormatLogfmt:
+		h.opts = logfmtOptions(h.opts)
+	}
+
+	if h.opts.AutoWidth {
+		h.width = new(atomic.Int64)
+		h.width.Store(int64(terminalWidth(w)))
+	}
+
+	h.vt = new(vtState)
+	h.vt.reset(w)
+
+	h.out = &output{w: h.optionalBOMWriter(w)}
+	if h.opts.AsyncWrite {
+		h.async = newAsyncWriter(h)
 	}
 
-	if h.out == nil {
-		h.out = os.Stderr
+	// static fields
+	if h.opts.IncludePID {
+		h = h.withAttrs([]slog.Attr{slog.Int("pid", os.Getpid())})
 	}
 
 	return
 }
 
+// NewSplit creates a ConsoleHandler that writes records of the ERROR and
+// higher levels to stderr and the rest to stdout.
+// Nil writers fallback to os.Stdout and os.Stderr
+func NewSplit(stdout, stderr io.Writer, opts *Options) (h *ConsoleHandler) {
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+
+	h = New(stdout, opts)
+	h.out.errW = h.optionalBOMWriter(stderr)
+	// both consoles must process the escape sequences
+	h.vt.reset(stdout, stderr)
+
+	return
+}
+
+// NewFromHandlerOptions creates a ConsoleHandler that writes to w with the
+// Level, AddSource and ReplaceAttr of the slog handler options, the rest
+// options are default. If ho is nil, the default options are used
+func NewFromHandlerOptions(w io.Writer, ho *slog.HandlerOptions) *ConsoleHandler {
+	if ho == nil {
+		return New(w, nil)
+	}
+
+	return New(w, &Options{
+		AddSource:   ho.AddSource,
+		Level:       ho.Level,
+		ReplaceAttr: ho.ReplaceAttr,
+	})
+}
+
 // Enabled reports whether the handler handles records at the given level.
 // The handler ignores records whose level is lower.
 func (h *ConsoleHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if lv := h.levelSet.Load(); lv != nil {
+		return level >= *lv
+	}
+
 	return level >= h.opts.Level.Level()
 }
 
+// SetLevel changes the minimum level of the handler and handlers derived with
+// WithAttrs and WithGroup. The *slog.LevelVar of Options.Level is set, other
+// levelers are not used after the call
+func (h *ConsoleHandler) SetLevel(level slog.Level) {
+	if lv, ok := h.opts.Level.(*slog.LevelVar); ok {
+		lv.Set(level)
+		return
+	}
+
+	h.levelSet.Store(&level)
+}
+
 // Handle formats its argument Record as a single line of space-separated key=value items.
-//   - Omits empty time or Options.DropTime is true
-//   - Level string. Can be changed with Options.StringLevel
+//   - Omits empty time or Options.DropTime is true.
+//     Time goes to the end of the line if Options.TimeLast is true
+//   - Level string. Can be changed with Options.StringLevel or omitted
+//     with Options.DropLevel
+//   - Message with newlines escaped, see Options.EscapeMessageNewlines
 //   - If the AddSource option is set and source information is available,
 //     the key is "source" and the value is output as FILE:LINE
+//   - Attributes keep the order they were added in: attributes of the
+//     With calls from the first to the last one, then the record attributes.
+//     Group members keep their order as well
+//   - If the RespectContextCancel option is set and ctx is done, nothing
+//     is written and ctx.Err() is returned
 //
 // See Options to modify other attributes
 func (h *ConsoleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if h.opts.RespectContextCancel && ctx != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if h.opts.MessageTemplate {
+		r = h.applyTemplate(r)
+	}
+
 	cm := newComposer(h)
 	defer cm.destruct()
+	if h.opts.ReplaceAttr != nil {
+		r = cm.replaceBuiltins(r)
+	}
+	if h.opts.EscapeMessageNewlines.Bool() && strings.ContainsAny(r.Message, "\n\r") {
+		r.Message = newlineEscaper.Replace(r.Message)
+	}
+	// deltas are computed between records only
+	cm.deltas = h.deltas
+	cm.collect = h.collectFields()
+	if h.opts.ColorizeLine && h.ColorEnabled() {
+		cm.lineColor = h.levelColor(r.Level)
+	}
+	if h.streaming() {
+		// the mutex is locked by the first chunk, a panic of the
+		// callbacks mustn't leave it locked
+		cm.streaming, cm.streamLevel = true, r.Level
+		defer cm.unlockStream()
+	}
 
-	// write timestamp
-	cm.appendTime(r.Time)
-	// write level
-	cm.appendLevel(r.Level)
-	// message
-	if len(r.Message) > 0 {
-		cm.addSpace(cm.bufLen() > 0)
-		cm.buf.writeString(r.Message)
-	}
-	// write source
-	cm.appendSource(r.PC)
-	// write preformatted
-	cm.addSpace(cm.bufLen() > 0 && len(h.preformatted) > 0)
-	cm.buf.write(h.preformatted)
-	// write record attributes
-	if r.NumAttrs() > 0 {
-		r.Attrs(cm.walkAttrs)
+	switch {
+	case h.opts.Format == FormatJSON:
+		cm.appendJSONRecord(ctx, r)
+	case h.opts.Format == FormatLogfmt:
+		cm.appendLogfmtRecord(ctx, r)
+	case h.layout != nil:
+		cm.appendLayout(ctx, r)
+	default:
+		cm.appendTextRecord(ctx, r)
+	}
+
+	if len(cm.lineColor) > 0 {
+		cm.optionalLineColor()
+		cm.buf.writeString(h.opts.ColorReset)
+	}
+
+	if h.opts.ExitLevel != nil && r.Level >= *h.opts.ExitLevel {
+		// queued records are written first, the record goes synchronously
+		h.Close()
+		// after the write
+		defer osExit(h.opts.ExitCode)
+	}
+
+	if cm.streaming {
+		cm.lockStream()
+		rotate, err := h.writeLocked(r.Level, cm.buf, cm.stamp)
+		cm.unlockStream()
+
+		if rotate || cm.rotate {
+			h.opts.OnRotate()
+		}
+		if cm.streamErr != nil {
+			return cm.streamErr
+		}
+		return err
+	}
+
+	if h.async != nil {
+		// the queue owns the buffer
+		buf := cm.buf
+		cm.buf = nil
+		if h.async.send(r.Level, buf, cm.stamp) {
+			return nil
+		}
+		cm.buf = buf
+	}
+
+	return h.write(r.Level, cm.buf, cm.stamp)
+}
+
+// write finishes the line and writes it to the output
+func (h *ConsoleHandler) write(lv slog.Level, buf *buffer, ts stamp) error {
+	h.mu.Lock()
+	rotate, err := h.writeLocked(lv, buf, ts)
+	h.mu.Unlock()
+
+	// out of the mutex, so OnRotate may call SetOutput
+	if rotate {
+		h.opts.OnRotate()
+	}
+
+	return err
+}
+
+// writeLocked must be called under the mutex. It reports whether
+// Options.MaxTotalBytes is reached
+func (h *ConsoleHandler) writeLocked(lv slog.Level, buf *buffer, ts stamp) (bool, error) {
+	w := h.writer(lv)
+	h.stampLocked(w, buf, ts)
+	// chain checksum depends on the write order
+	if h.opts.HashChain {
+		h.appendChecksum(buf)
+	}
+
+	if h.opts.TrailingSeparator {
+		buf.writeString(h.opts.FieldSeparator)
 	}
 
 	// at the end of the day new line
-	cm.buf.writeString("\n")
+	buf.writeString("\n")
+
+	n, err := w.Write(*buf)
+
+	return h.countWritten(n), err
+}
+
+// stampLocked must be called under the mutex. It replaces the full timestamp
+// with the sub-second one if the last line written to w has the same second,
+// see Options.SubSecondOnly
+func (h *ConsoleHandler) stampLocked(w io.Writer, buf *buffer, ts stamp) {
+	if ts.end == 0 {
+		return
+	}
+
+	// writers of the uncomparable types share the second
+	if !reflect.TypeOf(w).Comparable() {
+		w = nil
+	}
+	if h.out.secs == nil {
+		h.out.secs = make(map[io.Writer]int64)
+	}
+
+	sec := ts.tm.Unix()
+	if last, ok := h.out.secs[w]; ok && last == sec {
+		var sub [len(subSecondFormat)]byte
+		*buf = slices.Replace(*buf, ts.start, ts.end, ts.tm.AppendFormat(sub[:0], subSecondFormat)...)
+	}
+	h.out.secs[w] = sec
+}
+
+// countWritten must be called under the mutex. It reports whether
+// Options.MaxTotalBytes is reached and resets the counter then
+func (h *ConsoleHandler) countWritten(n int) bool {
+	if h.opts.MaxTotalBytes <= 0 || h.opts.OnRotate == nil {
+		return false
+	}
+	if h.out.written += int64(n); h.out.written < h.opts.MaxTotalBytes {
+		return false
+	}
+	h.out.written = 0
+
+	return true
+}
+
+// streaming reports whether Options.Streaming applies
+func (h *ConsoleHandler) streaming() bool {
+	return h.opts.Streaming && h.async == nil && h.layout == nil && !h.opts.HashChain && !h.opts.AttrsAsJSON && !h.collectFields()
+}
+
+// appendChecksum must be called under the mutex
+func (h *ConsoleHandler) appendChecksum(buf *buffer) {
+	hs := sha256.New()
+	hs.Write(h.chain[:])
+	hs.Write(*buf)
+	hs.Sum(h.chain[:0])
+
+	if len(*buf) > 0 {
+		buf.writeString(h.opts.FieldSeparator)
+	}
+	buf.writeString("chk")
+	buf.writeString(h.opts.KVSeparator)
+	var dst [checksumLen * 2]byte
+	hex.Encode(dst[:], h.chain[:checksumLen])
+	buf.write(dst[:])
+}
+
+// requestID returns Options.RequestIDKey value of the context as attribute,
+// it is empty if there is no value
+func (h *ConsoleHandler) requestID(ctx context.Context) slog.Attr {
+	if h.opts.RequestIDKey == nil || ctx == nil {
+		return slog.Attr{}
+	}
+
+	v := ctx.Value(h.opts.RequestIDKey)
+	if v == nil {
+		return slog.Attr{}
+	}
+
+	return slog.Any(h.opts.RequestIDAttr, v)
+}
+
+// applyTemplate returns the record with the message placeholders replaced by
+// the attributes, see Options.MessageTemplate
+func (h *ConsoleHandler) applyTemplate(r slog.Record) slog.Record {
+	if strings.IndexByte(r.Message, '{') < 0 || r.NumAttrs() == 0 {
+		return r
+	}
+
+	attrs := make([]slog.Attr, 0, r.NumAttrs())
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+
+	cm := newComposer(h)
+	defer cm.destruct()
+
+	msg := r.Message
+	for {
+		start := strings.IndexByte(msg, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(msg[start:], '}')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		cm.buf.writeString(msg[:start])
+		key := msg[start+1 : end]
+		i := slices.IndexFunc(attrs, func(a slog.Attr) bool {
+			return len(a.Key) > 0 && a.Key == key && a.Value.Kind() != slog.KindGroup
+		})
+		if i < 0 {
+			cm.buf.writeString(msg[start : end+1])
+		} else {
+			cm.appendTemplateValue(attrs[i].Value.Resolve())
+			attrs = slices.Delete(attrs, i, i+1)
+		}
+		msg = msg[end+1:]
+	}
+	cm.buf.writeString(msg)
+
+	r2 := slog.NewRecord(r.Time, r.Level, string(*cm.buf), r.PC)
+	r2.AddAttrs(attrs...)
+
+	return r2
+}
+
+// collectFields reports whether attributes are collected to be written at
+// once, see Options.AutoWidth, Options.MultiLine, Options.GroupBlocks and Options.SortAttrs
+func (h *ConsoleHandler) collectFields() bool {
+	return (h.opts.AlignAttrs || h.opts.AutoWidth || h.opts.DedupKeys || h.opts.GroupBlocks ||
+		h.opts.MultiLine || h.opts.SortAttrs != SortNone) && !h.opts.AttrsAsJSON
+}
+
+// SetOutput swaps the writer of the handler and handlers derived with
+// WithAttrs and WithGroup. They share the writer and the mutex, so the swap
+// is seen by all of them and lines are written either to the old writer or
+// to the new one as a whole. Other handlers made with New keep their writers.
+// If Options.Colorize was nil, colors are re-detected for the new writer,
+// so is the width if Options.AutoWidth is on
+func (h *ConsoleHandler) SetOutput(w io.Writer) {
+	if w == nil {
+		w = os.Stderr
+	}
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	_, err := h.out.Write(*cm.buf)
 
-	return err
+	delete(h.out.secs, h.out.w)
+	h.out.w = h.optionalBOMWriter(w)
+	h.out.written = 0
+	if h.autoColor != nil {
+		h.autoColor.Set(detectColor(w))
+	}
+	if h.width != nil {
+		h.width.Store(int64(terminalWidth(w)))
+	}
+	if h.out.errW != nil {
+		h.vt.reset(w, h.out.errW)
+	} else {
+		h.vt.reset(w)
+	}
+}
+
+// SetColorize turns colors on or off if Options.Colorize is *BoolVar, it is
+// nil or ColorMode is set. Otherwise it does nothing, as for FormatJSON and
+// FormatLogfmt. The auto-detected value is detected again by SetOutput
+func (h *ConsoleHandler) SetColorize(on bool) {
+	if bv, ok := h.opts.Colorize.(*BoolVar); ok {
+		bv.Set(on)
+	}
+}
+
+// Width returns the terminal width used to wrap the line if Options.AutoWidth
+// is on, otherwise zero
+func (h *ConsoleHandler) Width() int {
+	if h.width == nil {
+		return 0
+	}
+
+	return int(h.width.Load())
+}
+
+// ColorEnabled reports whether the "level" word is colorized.
+// On windows the console must process the escape sequences or FORCE_COLOR
+// must be set. The processing is turned on the first time Colorize is on
+func (h *ConsoleHandler) ColorEnabled() bool {
+	return h.opts.Colorize.Bool() && (h.vt.enabled() || h.forceColor)
+}
+
+// writer must be called under the mutex
+func (h *ConsoleHandler) writer(lv slog.Level) io.Writer {
+	if h.opts.WriterFor != nil {
+		if w := h.opts.WriterFor(lv); w != nil {
+			return w
+		}
+	}
+	if h.out.errW != nil && lv >= slog.LevelError {
+		return h.out.errW
+	}
+
+	return h.out.w
 }
 
 // WithAttrs returns a new ConsoleHandler
@@ -141,17 +685,53 @@ func mergePrefWithKey(pref, key string) string {
 	return key
 }
 
+// collapsePrefix keeps first n-1 and the last segments of the group prefix,
+// e.g. "a.b.c.d.e" with n = 3 becomes "a.b…e"
+func collapsePrefix(pref string, n int) string {
+	if n <= 0 || strings.Count(pref, ".") < n {
+		return pref
+	}
+
+	head := 0
+	for i := 1; i < n; i++ {
+		head += strings.IndexByte(pref[head:], '.') + 1
+	}
+	tail := strings.LastIndexByte(pref, '.') + 1
+
+	if head == 0 {
+		return groupOverflow + pref[tail:]
+	}
+	return pref[:head-1] + groupOverflow + pref[tail:]
+}
+
+// plainSet holds the value true if the ASCII character doesn't need quoting.
+// Quote anything except a backslash that would need quoting in a JSON string,
+// as well as space, '=' and DEL
+var plainSet = func() (set [utf8.RuneSelf]bool) {
+	for b := range set {
+		set[b] = b == '\\' || (b != ' ' && b != '=' && b != 0x7f && safeSet[b])
+	}
+	return
+}()
+
 // Copied from slog/text_handler.go
 func needsQuoting(s string) bool {
 	if len(s) == 0 {
 		return true
 	}
-	for i := 0; i < len(s); {
+	// fast path for the common plain ASCII values
+	i := 0
+	for i < len(s) && s[i] < utf8.RuneSelf && plainSet[s[i]] {
+		i++
+	}
+	if i == len(s) {
+		return false
+	}
+
+	for i < len(s) {
 		b := s[i]
 		if b < utf8.RuneSelf {
-			// Quote anything except a backslash that would need quoting in a
-			// JSON string, as well as space and '='
-			if b != '\\' && (b == ' ' || b == '=' || !safeSet[b]) {
+			if !plainSet[b] {
 				return true
 			}
 			i++
@@ -170,6 +750,9 @@ func (h *ConsoleHandler) withGroup(name string) *ConsoleHandler {
 	if name == "" {
 		return h
 	}
+	if h.opts.MergeDuplicateGroups && len(h.groups) > 0 && h.groups[len(h.groups)-1] == name {
+		return h
+	}
 
 	h2 := *h
 
@@ -180,7 +763,7 @@ func (h *ConsoleHandler) withGroup(name string) *ConsoleHandler {
 	if len(*buf) > 0 {
 		buf.writeByte('.')
 	}
-	buf.writeString(name)
+	buf.writeString(h.groupName(name))
 	h2.prefix = string(*buf)
 
 	// groups list to use them in the AttrReplace
@@ -191,15 +774,51 @@ func (h *ConsoleHandler) withGroup(name string) *ConsoleHandler {
 	return &h2
 }
 
+var keySeparatorEscaper = strings.NewReplacer(`\`, `\\`, ".", `\.`)
+
+// groupName escapes the key separator in the group name if Options.EscapeKeySeparator is on
+func (h *ConsoleHandler) groupName(name string) string {
+	if !h.opts.EscapeKeySeparator {
+		return name
+	}
+
+	return keySeparatorEscaper.Replace(name)
+}
+
 func (h *ConsoleHandler) withAttrs(attrs []slog.Attr) *ConsoleHandler {
 	if len(attrs) == 0 {
 		return h
 	}
 
+	if h.opts.SortPreformatted {
+		attrs = slices.Clone(attrs)
+		slices.SortStableFunc(attrs, func(a, b slog.Attr) int {
+			return strings.Compare(a.Key, b.Key)
+		})
+	}
+
+	if h.opts.AttrsAsJSON {
+		return h.withJSONAttrs(attrs)
+	}
+
 	h2 := *h
 
 	cm := newComposer(h)
 	defer cm.destruct()
+	cm.reserveStatic()
+
+	if h.collectFields() {
+		cm.collect = true
+		for _, a := range attrs {
+			cm.appendAttr(a, h2.prefix)
+		}
+
+		h2.prefields = make([]field, 0, len(h.prefields)+len(cm.fields))
+		h2.prefields = append(h2.prefields, h.prefields...)
+		h2.prefields = append(h2.prefields, cm.fields...)
+
+		return &h2
+	}
 
 	cm.buf.write(h.preformatted)
 	for _, a := range attrs {
@@ -3,12 +3,20 @@ package slogconsole
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"os"
+	"path"
+	"reflect"
 	"regexp"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -62,8 +70,19 @@ const (
 	testConsoleColorCyan   = "\033\\[36m"
 	testConsoleColorGray   = "\033\\[37m"
 	testConsoleColorWhite  = "\033\\[97m"
+
+	testConsoleColorDarkGray = "\033\\[90m"
+	testConsoleBold          = "\033\\[1m"
 )
 
+// coloredTimeRE matches the time colorized by default
+func coloredTimeRE() string {
+	if runtime.GOOS == "windows" {
+		return timeRE
+	}
+	return testConsoleColorDarkGray + timeRE + testConsoleColorReset
+}
+
 func TestConsoleTextHandler(t *testing.T) {
 	buf := bytes.NewBuffer(make([]byte, 0, 1024))
 
@@ -212,7 +231,7 @@ func TestConsoleTextHandler(t *testing.T) {
 				if runtime.GOOS != "windows" {
 					lv = testConsoleColorWhite + lv + testConsoleColorReset
 				}
-				return timeRE + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
+				return coloredTimeRE() + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
 			}(),
 			opts: &Options{
 				Colorize: newBoolBar(true),
@@ -229,7 +248,7 @@ func TestConsoleTextHandler(t *testing.T) {
 				if runtime.GOOS != "windows" {
 					lv = testConsoleColorGreen + lv + testConsoleColorReset
 				}
-				return timeRE + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
+				return coloredTimeRE() + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
 			}(),
 			opts: &Options{
 				Colorize: newBoolBar(true),
@@ -246,7 +265,7 @@ func TestConsoleTextHandler(t *testing.T) {
 				if runtime.GOOS != "windows" {
 					lv = testConsoleColorYellow + lv + testConsoleColorReset
 				}
-				return timeRE + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
+				return coloredTimeRE() + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
 			}(),
 			opts: &Options{
 				Colorize: newBoolBar(true),
@@ -263,7 +282,7 @@ func TestConsoleTextHandler(t *testing.T) {
 				if runtime.GOOS != "windows" {
 					lv = testConsoleColorRed + lv + testConsoleColorReset
 				}
-				return timeRE + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
+				return coloredTimeRE() + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
 			}(),
 			opts: &Options{
 				Colorize: newBoolBar(true),
@@ -280,7 +299,7 @@ func TestConsoleTextHandler(t *testing.T) {
 				if runtime.GOOS != "windows" {
 					lv = testConsoleColorRed + lv + testConsoleColorReset
 				}
-				return timeRE + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
+				return coloredTimeRE() + ` ` + lv + ` ` + testMessage + ` grp.key=` + strconv.Itoa(testInt)
 			}(),
 			opts: &Options{
 				Colorize: newBoolBar(true),
@@ -316,3 +335,3512 @@ func TestConsoleTextHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestConsoleTextHandlerSubSecondOnly(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	hd := New(buf, &Options{
+		Colorize:      newBoolBar(false),
+		SubSecondOnly: true,
+	})
+
+	for _, tm := range []time.Time{
+		testTime.Add(100 * time.Millisecond),
+		testTime.Add(123 * time.Millisecond),
+		testTime.Add(time.Second),
+	} {
+		r := slog.NewRecord(tm, slog.LevelInfo, testMessage, 0)
+		if err := hd.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkLogOutput(t, buf.String(),
+		`2023-09-10 20:00:00\.100 INFO `+testMessage+
+			`~\.123 INFO `+testMessage+
+			`~2023-09-10 20:00:01\.000 INFO `+testMessage)
+}
+
+func TestConsoleTextHandlerSubSecondOnlyWriteOrder(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	// the first record of the handler has the full time at second zero too
+	r := slog.NewRecord(time.Unix(0, 5e6), slog.LevelInfo, testMessage, 0)
+	if err := New(buf, &Options{Colorize: newBoolBar(false), SubSecondOnly: true, UTC: true}).Handle(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	checkLogOutput(t, buf.String(), `1970-01-01 00:00:00\.005 INFO `+testMessage)
+
+	for _, async := range []bool{false, true} {
+		buf.Reset()
+		h := New(buf, &Options{AsyncWrite: async, Colorize: newBoolBar(false), SubSecondOnly: true})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				r := slog.NewRecord(testTime.Add(time.Duration(i)*time.Millisecond), slog.LevelInfo, testMessage, 0)
+				_ = h.Handle(context.Background(), r)
+			}(i)
+		}
+		wg.Wait()
+		h.Close()
+
+		// the full time goes first whatever record is written first
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		if len(lines) != 50 || !strings.HasPrefix(lines[0], "2023-09-10 20:00:00.") {
+			t.Fatalf("async %v: got first line %q of %d", async, lines[0], len(lines))
+		}
+		for _, line := range lines[1:] {
+			if !strings.HasPrefix(line, ".") {
+				t.Errorf("async %v: got %q, want the sub-second time", async, line)
+			}
+		}
+	}
+}
+
+func TestConsoleTextHandlerSubSecondOnlyLayouts(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"colorized line", &Options{ColorizeLine: true, Colorize: newBoolBar(true)},
+			ConsoleColorGreen + "2023-09-10 20:00:00.100 INFO hello" + ConsoleColorReset + "\n" +
+				ConsoleColorGreen + ".101 INFO hello" + ConsoleColorReset + "\n"},
+		{"template", &Options{Template: "{level} {time} {msg}"},
+			"INFO 2023-09-10 20:00:00.100 hello\nINFO .101 hello\n"},
+		{"time last", &Options{TimeLast: true},
+			"INFO hello 2023-09-10 20:00:00.100\nINFO hello .101\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opts.Colorize == nil {
+				test.opts.Colorize = newBoolBar(false)
+			}
+			test.opts.SubSecondOnly = true
+
+			h := New(buf, test.opts)
+			for _, ms := range []time.Duration{100, 101} {
+				r := slog.NewRecord(testTime.Add(ms*time.Millisecond), slog.LevelInfo, "hello", 0)
+				if err := h.Handle(context.Background(), r); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			buf.Reset()
+		})
+	}
+
+	// each writer of NewSplit gets the full time first
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	h := NewSplit(out, errOut, &Options{Colorize: newBoolBar(false), SubSecondOnly: true})
+	for _, lv := range []slog.Level{slog.LevelInfo, slog.LevelError, slog.LevelInfo} {
+		r := slog.NewRecord(testTime.Add(100*time.Millisecond), lv, "hello", 0)
+		if err := h.Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := out.String(), "2023-09-10 20:00:00.100 INFO hello\n.100 INFO hello\n"; got != want {
+		t.Errorf("stdout: got %q, want %q", got, want)
+	}
+	if got, want := errOut.String(), "2023-09-10 20:00:00.100 ERROR hello\n"; got != want {
+		t.Errorf("stderr: got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerKeyTransform(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	snakeToCamel := func(s string) string {
+		parts := strings.Split(s, "_")
+		for i := 1; i < len(parts); i++ {
+			if len(parts[i]) > 0 {
+				parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+			}
+		}
+		return strings.Join(parts, "")
+	}
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:     newBoolBar(false),
+		DropTime:     true,
+		KeyTransform: snakeToCamel,
+	}))
+
+	logger.WithGroup("req").With(slog.String("user_id", "42")).Info(testMessage,
+		slog.Group("http_req", slog.Int("status_code", 200)),
+	)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` req.userId=42 req.httpReq.statusCode=200`)
+}
+
+func TestConsoleTextHandlerHashChain(t *testing.T) {
+	log := func(msgs ...string) []string {
+		buf := bytes.NewBuffer(make([]byte, 0, 1024))
+		hd := New(buf, &Options{
+			Colorize:  newBoolBar(false),
+			HashChain: true,
+		})
+		for _, msg := range msgs {
+			r := slog.NewRecord(testTime, slog.LevelInfo, msg, 0)
+			if err := hd.Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		for i, line := range lines {
+			checkLogOutput(t, line, timeRE+` INFO `+msgs[i]+` chk=[0-9a-f]{16}`)
+			lines[i] = line[strings.LastIndex(line, "chk="):]
+		}
+		return lines
+	}
+
+	a := log("first", "second")
+	b := log("first", "second")
+	c := log("changed", "second")
+
+	if a[0] != b[0] || a[1] != b[1] {
+		t.Errorf("same input, different chain: %v != %v", a, b)
+	}
+	if a[0] == a[1] {
+		t.Errorf("chain didn't change between lines: %v", a)
+	}
+	if a[1] == c[1] {
+		t.Errorf("changed line didn't affect following digest: %v, %v", a, c)
+	}
+}
+
+func TestConsoleTextHandlerPaletteVar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	pl := new(PaletteVar)
+	logger := slog.New(New(buf, &Options{
+		Colorize: newBoolBar(true),
+		DropTime: true,
+		Palette:  pl,
+	}))
+
+	logger.Info(testMessage)
+	checkLogOutput(t, buf.String(), testConsoleColorGreen+`INFO`+testConsoleColorReset+` `+testMessage)
+	buf.Reset()
+
+	pl.Set(Palette{Info: ConsoleColorCyan})
+	logger.Info(testMessage)
+	checkLogOutput(t, buf.String(), testConsoleColorCyan+`INFO`+testConsoleColorReset+` `+testMessage)
+}
+
+func TestConsoleTextHandlerPaletteVarConcurrent(t *testing.T) {
+	pl := new(PaletteVar)
+	logger := slog.New(New(io.Discard, &Options{
+		Colorize: newBoolBar(true),
+		Palette:  pl,
+	}))
+
+	themes := []Palette{
+		DefaultPalette(),
+		{ConsoleColorGray, ConsoleColorCyan, ConsoleColorPurple, ConsoleColorBlue},
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				logger.Warn(testMessage, "key", j)
+			}
+		}()
+	}
+	for j := 0; j < 1000; j++ {
+		pl.Set(themes[j%len(themes)])
+	}
+	wg.Wait()
+}
+
+func TestConsoleTextHandlerAttrsAsJSON(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		want string
+		call func(*slog.Logger)
+	}{
+		{
+			name: "msg",
+			want: `INFO ` + testMessage,
+			call: func(lg *slog.Logger) {
+				lg.WithGroup("grp").Info(testMessage)
+			},
+		},
+		{
+			name: "msg+attrs",
+			want: `INFO ` + testMessage + ` {"str":"quote me","int":` + strconv.Itoa(testInt) + `}`,
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage, "str", "quote me", "int", testInt)
+			},
+		},
+		{
+			name: "msg+grp+attrs+grp+attr",
+			want: `INFO ` + testMessage +
+				` {"grp":{"strkey":"` + testString + `","duration":"` + testDuration.String() +
+				`","grp2":{"key":` + strconv.Itoa(testInt) + `,"inner":{"err":"` + testError.Error() + `"}}}}`,
+			call: func(lg *slog.Logger) {
+				lg.WithGroup("grp").With(
+					slog.String("strkey", testString),
+					slog.Duration("duration", testDuration),
+				).WithGroup("grp2").Info(testMessage,
+					slog.Int("key", testInt),
+					slog.Group("inner", slog.Any("err", testError)),
+				)
+			},
+		},
+		{
+			name: "with+grp only",
+			want: `INFO ` + testMessage + ` {"key":` + strconv.Itoa(testInt) + `}`,
+			call: func(lg *slog.Logger) {
+				lg.With("key", testInt).WithGroup("grp").Info(testMessage)
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				AttrsAsJSON: true,
+				Colorize:    newBoolBar(false),
+				DropTime:    true,
+			}))
+
+			test.call(logger)
+
+			checkLogOutput(t, buf.String(), regexp.QuoteMeta(test.want))
+
+			if i := strings.IndexByte(buf.String(), '{'); i >= 0 {
+				if obj := buf.Bytes()[i:]; !json.Valid(obj) {
+					t.Errorf("invalid json: %s", obj)
+				}
+			}
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerAttrsAsJSONEmptyGroups(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		AttrsAsJSON: true,
+		Colorize:    newBoolBar(false),
+		DropTime:    true,
+		IncludeAttr: func(_ []string, a slog.Attr) bool { return a.Key != "drop" },
+	}))
+
+	for _, test := range []struct {
+		name string
+		want string
+		call func(*slog.Logger)
+	}{
+		{"record", `INFO m`, func(lg *slog.Logger) {
+			lg.WithGroup("grp").Info("m", "drop", 1)
+		}},
+		{"nested", `INFO m {"grp":{"k":1}}`, func(lg *slog.Logger) {
+			lg.WithGroup("grp").Info("m", "k", 1, slog.Group("sub", "drop", 1))
+		}},
+		{"with", `INFO m {"a":1,"grp":{"k":1}}`, func(lg *slog.Logger) {
+			lg.With("a", 1).WithGroup("grp").With("drop", 1).Info("m", "k", 1)
+		}},
+		{"with dropped", `INFO m {"a":1}`, func(lg *slog.Logger) {
+			lg.With("a", 1).WithGroup("grp").With("drop", 1).WithGroup("sub").Info("m", "drop", 2)
+		}},
+		{"with opened later", `INFO m {"grp":{"sub":{"k":1}}}`, func(lg *slog.Logger) {
+			lg.WithGroup("grp").With("drop", 1).WithGroup("sub").Info("m", "k", 1)
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.call(logger)
+
+			checkLogOutput(t, buf.String(), regexp.QuoteMeta(test.want))
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerDeltaKeys(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:  newBoolBar(false),
+		DeltaKeys: []string{"elapsed", "step.at"},
+		DropTime:  true,
+	}))
+
+	logger.Info(testMessage, "elapsed", 900*time.Millisecond, slog.Group("step", "at", testTime))
+	logger.Info(testMessage, "elapsed", 1200*time.Millisecond, slog.Group("step", "at", testTime.Add(-time.Second)))
+	logger.Info(testMessage, "elapsed", 1200*time.Millisecond, "other", time.Second)
+
+	checkLogOutput(t, buf.String(),
+		`INFO `+testMessage+` elapsed=900ms step.at=2023-09-10 20:00:00\.000`+
+			`~INFO `+testMessage+` elapsed=1.2s \(\+300ms\) step.at=2023-09-10 19:59:59\.000 \(-1s\)`+
+			`~INFO `+testMessage+` elapsed=1.2s \(\+0s\) other=1s`)
+	buf.Reset()
+
+	// the delta is separated like the fields
+	logger = slog.New(New(buf, &Options{
+		Colorize:       newBoolBar(false),
+		DeltaKeys:      []string{"elapsed"},
+		DropTime:       true,
+		FieldSeparator: "\t",
+	}))
+
+	logger.Info(testMessage, "elapsed", 900*time.Millisecond)
+	logger.Info(testMessage, "elapsed", 1200*time.Millisecond)
+
+	checkLogOutput(t, buf.String(),
+		"INFO\t"+testMessage+"\telapsed=900ms"+
+			"~INFO\t"+testMessage+"\telapsed=1.2s\t\\(\\+300ms\\)")
+}
+
+func TestConsoleTextHandlerStringLevelFunc(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	stringLevel := func(lv slog.Level, colored bool) string {
+		if colored && lv >= slog.LevelError {
+			return "ERR"
+		}
+		return lv.String()
+	}
+
+	for _, test := range []struct {
+		name  string
+		color bool
+		want  string
+	}{
+		{
+			name:  "plain",
+			color: false,
+			want:  `ERROR ` + testMessage,
+		},
+		{
+			name:  "colored",
+			color: true,
+			want: func() string {
+				if runtime.GOOS == "windows" {
+					return `ERROR ` + testMessage
+				}
+				return testConsoleColorRed + `ERR` + testConsoleColorReset + ` ` + testMessage
+			}(),
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:        newBoolBar(test.color),
+				DropTime:        true,
+				StringLevel:     func(slog.Level) string { return "ignored" },
+				StringLevelFunc: stringLevel,
+			}))
+
+			logger.Error(testMessage)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerNewSplit(t *testing.T) {
+	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(NewSplit(stdout, stderr, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+		Level:    slog.LevelDebug,
+	})).With("key", testInt)
+
+	logger.Debug(testMessage)
+	logger.Info(testMessage)
+	logger.Warn(testMessage)
+	logger.Error(testMessage)
+	logger.Log(context.Background(), slog.LevelError+4, testMessage)
+
+	checkLogOutput(t, stdout.String(),
+		`DEBUG `+testMessage+` key=\d+`+
+			`~INFO `+testMessage+` key=\d+`+
+			`~WARN `+testMessage+` key=\d+`)
+	checkLogOutput(t, stderr.String(),
+		`ERROR `+testMessage+` key=\d+`+
+			`~ERROR\+4 `+testMessage+` key=\d+`)
+}
+
+func TestConsoleTextHandlerMultiLine(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:  newBoolBar(false),
+		DropTime:  true,
+		MultiLine: true,
+	}))
+
+	logger.WithGroup("grp").With(
+		slog.String("strkey", testString),
+	).Info(testMessage,
+		slog.Int("n", testInt),
+		slog.Group("inner", slog.Duration("duration", testDuration)),
+	)
+	logger.Info(testMessage)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+
+		`~  grp.strkey        =`+testString+
+		`~  grp.n             =`+strconv.Itoa(testInt)+
+		`~  grp.inner.duration=`+testDuration.String()+
+		`~INFO `+testMessage)
+}
+
+func TestConsoleTextHandlerMultiLineColors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:   newBoolBar(true),
+		DropTime:   true,
+		KeyColor:   ConsoleColorCyan,
+		MultiLine:  true,
+		ValueColor: ConsoleColorBlue,
+	}))
+
+	logger.WithGroup("grp").Info(testMessage,
+		slog.Int("n", testInt),
+		slog.Group("inner", slog.String("key", "val")),
+	)
+
+	key := func(k string) string { return testConsoleColorCyan + k + testConsoleColorReset }
+	val := func(v string) string { return testConsoleColorBlue + v + testConsoleColorReset }
+	checkLogOutput(t, buf.String(), testConsoleColorGreen+`INFO`+testConsoleColorReset+` `+testMessage+
+		`~  `+key(`grp\.n`)+`        =`+val(strconv.Itoa(testInt))+
+		`~  `+key(`grp\.inner\.key`)+`=`+val(`val`))
+}
+
+func TestConsoleTextHandlerGroupBlocks(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:    newBoolBar(false),
+		DropTime:    true,
+		GroupBlocks: true,
+	}))
+
+	logger.Info(testMessage,
+		slog.Int("n", testInt),
+		slog.Group("req", slog.String("method", "GET"), slog.Group("url", slog.String("path", "/"))),
+		slog.Group("resp", slog.Int("status", 200)),
+	)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` n=`+strconv.Itoa(testInt)+
+		`~  req:`+
+		`~    method  =GET`+
+		`~    url.path=/`+
+		`~  resp:`+
+		`~    status=200`)
+}
+
+func TestConsoleTextHandlerRespectContextCancel(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, 0)
+
+	hd := New(buf, &Options{
+		Colorize:             newBoolBar(false),
+		RespectContextCancel: true,
+	})
+	if err := hd.Handle(ctx, r); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	// default slog semantics
+	hd = New(buf, &Options{
+		Colorize: newBoolBar(false),
+	})
+	if err := hd.Handle(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	checkLogOutput(t, buf.String(), timeRE+` INFO `+testMessage)
+}
+
+func TestConsoleTextHandlerMaxGroupPrefixSegments(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		limit int
+		want  string
+	}{
+		{0, `g1.g2.g3.g4.g5.g6.key=1 g1.g2.g3.g4.g5.g6.inner.key=2`},
+		{1, `…g6.key=1 …inner.key=2`},
+		{3, `g1.g2…g6.key=1 g1.g2…inner.key=2`},
+		{6, `g1.g2.g3.g4.g5.g6.key=1 g1.g2.g3.g4.g5…inner.key=2`},
+		{7, `g1.g2.g3.g4.g5.g6.key=1 g1.g2.g3.g4.g5.g6.inner.key=2`},
+	} {
+		t.Run(strconv.Itoa(test.limit), func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:               newBoolBar(false),
+				DropTime:               true,
+				MaxGroupPrefixSegments: test.limit,
+			}))
+
+			for _, g := range []string{"g1", "g2", "g3", "g4", "g5", "g6"} {
+				logger = logger.WithGroup(g)
+			}
+			logger.Info(testMessage, "key", 1, slog.Group("inner", "key", 2))
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerTimeLast(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{
+			name: "time last",
+			opts: &Options{TimeLast: true},
+			want: `INFO ` + testMessage + ` key=` + strconv.Itoa(testInt) + ` ` + timeRE,
+		},
+		{
+			name: "time last dropped",
+			opts: &Options{TimeLast: true, DropTime: true},
+			want: `INFO ` + testMessage + ` key=` + strconv.Itoa(testInt),
+		},
+		{
+			name: "time last multiline",
+			opts: &Options{TimeLast: true, MultiLine: true},
+			want: `INFO ` + testMessage + `~  key=` + strconv.Itoa(testInt) + ` ` + timeRE,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			logger := slog.New(New(buf, test.opts))
+
+			logger.Info(testMessage, "key", testInt)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerWriteBOM(t *testing.T) {
+	stdout := bytes.NewBuffer(make([]byte, 0, 1024))
+	stderr := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(NewSplit(stdout, stderr, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+		WriteBOM: true,
+	}))
+
+	logger.Info(testMessage)
+	logger.With("key", 1).Info(testMessage)
+	logger.Error(testMessage)
+
+	checkLogOutput(t, stdout.String(), utf8BOM+"INFO "+testMessage+"~INFO "+testMessage+" key=1")
+	checkLogOutput(t, stderr.String(), utf8BOM+"ERROR "+testMessage)
+}
+
+// fakeTerminal is a buffer pretending to be a terminal
+type fakeTerminal struct {
+	bytes.Buffer
+}
+
+func (*fakeTerminal) IsTerminal() bool {
+	return true
+}
+
+func TestConsoleTextHandlerSetOutputColor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("FORCE_COLOR", "")
+
+	term := new(fakeTerminal)
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	hd := New(term, &Options{DropTime: true})
+	logger := slog.New(hd).With("key", testInt)
+
+	if !hd.ColorEnabled() {
+		t.Error("color is off for a terminal")
+	}
+	logger.Info(testMessage)
+	checkLogOutput(t, term.String(), testConsoleColorGreen+`INFO`+testConsoleColorReset+` `+testMessage+` key=\d+`)
+
+	hd.SetOutput(buf)
+	if hd.ColorEnabled() {
+		t.Error("color is on for a buffer")
+	}
+	logger.Info(testMessage)
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` key=\d+`)
+
+	// explicit value is kept
+	hd = New(term, &Options{Colorize: newBoolBar(true)})
+	hd.SetOutput(buf)
+	if !hd.ColorEnabled() {
+		t.Error("explicit color is reset")
+	}
+}
+
+func TestConsoleTextHandlerSetOutputConcurrent(t *testing.T) {
+	bufs := [2]*bytes.Buffer{new(bytes.Buffer), new(bytes.Buffer)}
+
+	hd := New(bufs[0], &Options{Colorize: newBoolBar(false), DropTime: true})
+	logger := slog.New(hd).WithGroup("grp")
+
+	const workers, lines = 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				logger.Info(testMessage, "n", j)
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		hd.SetOutput(bufs[(i+1)%2])
+	}
+	wg.Wait()
+
+	total := 0
+	for _, buf := range bufs {
+		for _, line := range strings.SplitAfter(buf.String(), "\n") {
+			if len(line) == 0 {
+				continue
+			}
+			if !strings.HasPrefix(line, `INFO `+testMessage+` grp.n=`) || !strings.HasSuffix(line, "\n") {
+				t.Fatalf("broken line %q", line)
+			}
+			total++
+		}
+	}
+	if total != workers*lines {
+		t.Fatalf("got %d lines, want %d", total, workers*lines)
+	}
+}
+
+func TestConsoleTextHandlerLevelFormat(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		format LevelFormat
+		level  slog.Level
+		want   string
+	}{
+		{"", slog.LevelInfo, `INFO`},
+		{LevelFormatName, slog.LevelWarn, `WARN`},
+		{LevelFormatNameNum, slog.LevelDebug, `DEBUG\(-4\)`},
+		{LevelFormatNameNum, slog.LevelInfo, `INFO\(0\)`},
+		{LevelFormatNameNum, slog.LevelError, `ERROR\(8\)`},
+		{LevelFormatNameNum, slog.LevelError + 4, `ERROR\+4\(12\)`},
+		{LevelFormatNameNum, slog.LevelDebug - 2, `DEBUG-2\(-6\)`},
+		{LevelFormatChar, slog.LevelWarn, `W`},
+		{LevelFormatChar, slog.LevelError + 4, `E`},
+	} {
+		t.Run(string(test.format)+" "+test.level.String(), func(t *testing.T) {
+			hd := New(buf, &Options{
+				Colorize:    newBoolBar(false),
+				DropTime:    true,
+				Level:       slog.LevelDebug - 4,
+				LevelFormat: test.format,
+			})
+
+			slog.New(hd).Log(context.Background(), test.level, testMessage)
+			checkLogOutput(t, buf.String(), test.want+` `+testMessage)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerEscapeKeySeparator(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name   string
+		escape bool
+		want   string
+	}{
+		{"off", false, `a.b.c.key=1 a.b.c.d.e.key=2`},
+		{"on", true, `a\\.b.c.key=1 a\\.b.c.d\\.e.key=2`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:           newBoolBar(false),
+				DropTime:           true,
+				EscapeKeySeparator: test.escape,
+			}))
+
+			logger.WithGroup("a.b").WithGroup("c").Info(testMessage,
+				"key", 1,
+				slog.Group("d.e", "key", 2),
+			)
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+// lineCounter counts lines written concurrently
+type lineCounter struct {
+	mu    sync.Mutex
+	lines int
+}
+
+func (lc *lineCounter) Write(p []byte) (int, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.lines += bytes.Count(p, []byte{'\n'})
+	return len(p), nil
+}
+
+func TestConsoleTextHandlerAsyncWrite(t *testing.T) {
+	const goroutines, records = 8, 1000
+
+	out := new(lineCounter)
+	hd := New(out, &Options{
+		AsyncQueueSize: 16,
+		AsyncWrite:     true,
+	})
+	logger := slog.New(hd).WithGroup("grp")
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				logger.Info(testMessage, "key", j)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := hd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.lines != goroutines*records {
+		t.Errorf("got %d lines, want %d", out.lines, goroutines*records)
+	}
+
+	// written synchronously after close
+	logger.Info(testMessage)
+	if out.lines != goroutines*records+1 {
+		t.Errorf("got %d lines after close, want %d", out.lines, goroutines*records+1)
+	}
+	if err := hd.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingWriter blocks writes until released
+type blockingWriter struct {
+	lineCounter
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	select {
+	case bw.entered <- struct{}{}:
+	default:
+	}
+	<-bw.release
+
+	return bw.lineCounter.Write(p)
+}
+
+func TestConsoleTextHandlerOnQueueFull(t *testing.T) {
+	out := &blockingWriter{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	hd := New(out, &Options{
+		AsyncQueueSize: 2,
+		AsyncWrite:     true,
+		OnQueueFull:    QueueFullDrop,
+	})
+	logger := slog.New(hd)
+
+	// taken by the writer goroutine
+	logger.Info(testMessage)
+	<-out.entered
+	// fill the queue
+	logger.Info(testMessage)
+	logger.Info(testMessage)
+	// dropped
+	logger.Info(testMessage)
+	logger.Info(testMessage)
+
+	if n := hd.Dropped(); n != 2 {
+		t.Errorf("got %d dropped, want 2", n)
+	}
+
+	close(out.release)
+	if err := hd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if out.lines != 3 {
+		t.Errorf("got %d lines, want 3", out.lines)
+	}
+}
+
+func TestConsoleTextHandlerAttrsOrder(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	const want = `INFO ` + testMessage +
+		` z=1 a=2 g1.y=3 g1.b=4 g1.g2.x=5 g1.g2.c.w=6 g1.g2.c.d=7 g1.g2.v=8 g1.g2.e=9`
+
+	for _, opts := range []*Options{
+		{},
+		{AsyncWrite: true},
+	} {
+		opts.Colorize = newBoolBar(false)
+		opts.DropTime = true
+
+		hd := New(buf, opts)
+		logger := slog.New(hd).
+			With("z", 1, "a", 2).
+			WithGroup("g1").With("y", 3).With("b", 4).
+			WithGroup("g2").With("x", 5, slog.Group("c", "w", 6, "d", 7))
+
+		// run several times to catch any nondeterminism
+		for i := 0; i < 10; i++ {
+			logger.Info(testMessage, "v", 8, "e", 9)
+		}
+		if err := hd.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		checkLogOutput(t, buf.String(), strings.Repeat(want+"~", 9)+want)
+		buf.Reset()
+	}
+}
+
+func TestConsoleTextHandlerColorMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	for _, test := range []struct {
+		name       string
+		mode       ColorMode
+		term       bool
+		noColor    string
+		forceColor string
+		want       bool
+	}{
+		{"auto terminal", ColorAuto, true, "", "", true},
+		{"auto terminal NO_COLOR", ColorAuto, true, "1", "", false},
+		{"auto buffer", ColorAuto, false, "", "", false},
+		{"auto buffer FORCE_COLOR", ColorAuto, false, "", "1", true},
+		{"auto buffer FORCE_COLOR=0", ColorAuto, false, "", "0", false},
+		{"auto terminal NO_COLOR FORCE_COLOR", ColorAuto, true, "1", "1", false},
+		{"always buffer", ColorAlways, false, "1", "", true},
+		{"never terminal", ColorNever, true, "", "", false},
+		{"never terminal FORCE_COLOR", ColorNever, true, "", "1", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", test.noColor)
+			t.Setenv("FORCE_COLOR", test.forceColor)
+
+			var w io.Writer = new(bytes.Buffer)
+			if test.term {
+				w = new(fakeTerminal)
+			}
+
+			// Colorize is overridden
+			hd := New(w, &Options{
+				Colorize:  newBoolBar(!test.want),
+				ColorMode: test.mode,
+			})
+			if got := hd.ColorEnabled(); got != test.want {
+				t.Errorf("got color %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// groupValuer resolves to a group
+type groupValuer struct {
+	id   int
+	name string
+}
+
+func (v groupValuer) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", v.id),
+		slog.Any("inner", innerValuer(v.name)),
+	)
+}
+
+// innerValuer resolves to a group of the group
+type innerValuer string
+
+func (v innerValuer) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("name", string(v)))
+}
+
+func TestConsoleTextHandlerLogValuerGroup(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{
+			name: "text",
+			opts: &Options{},
+			want: ` grp.with.id=1 grp.with.inner.name=a grp.user.id=2 grp.user.inner.name="b c"`,
+		},
+		{
+			name: "json",
+			opts: &Options{AttrsAsJSON: true},
+			want: ` \{"grp":\{"with":\{"id":1,"inner":\{"name":"a"\}\},"user":\{"id":2,"inner":\{"name":"b c"\}\}\}\}`,
+		},
+		{
+			name: "replace attr",
+			opts: &Options{
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Value.Kind() == slog.KindLogValuer {
+						t.Errorf("%s is not resolved", a.Key)
+					}
+					return a
+				},
+			},
+			want: ` grp.with.id=1 grp.with.inner.name=a grp.user.id=2 grp.user.inner.name="b c"`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+
+			logger := slog.New(New(buf, test.opts))
+			logger.WithGroup("grp").
+				With("with", groupValuer{1, "a"}).
+				Info(testMessage, "user", groupValuer{2, "b c"})
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerIncludeAttr(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	// drop secrets of the "auth" group at any level
+	include := func(groups []string, a slog.Attr) bool {
+		if len(groups) > 0 && groups[len(groups)-1] == "auth" {
+			return a.Key != "token"
+		}
+		return a.Key != "skip"
+	}
+
+	for _, test := range []struct {
+		name      string
+		opts      *Options
+		wantGroup string
+		want      string
+	}{
+		{
+			name:      "text",
+			opts:      &Options{},
+			wantGroup: ` req.user=a req.auth.kind=basic`,
+			want:      ` req.user=a req.auth.kind=basic req.id=1 req.http.auth.kind=bearer`,
+		},
+		{
+			name:      "json",
+			opts:      &Options{AttrsAsJSON: true},
+			wantGroup: ` \{"req":\{"user":"a","auth":\{"kind":"basic"\}\}\}`,
+			want:      ` \{"req":\{"user":"a","auth":\{"kind":"basic"\},"id":1,"http":\{"auth":\{"kind":"bearer"\}\}\}\}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.IncludeAttr = include
+
+			logger := slog.New(New(buf, test.opts))
+			logger.WithGroup("req").
+				With("user", "a", "skip", 1).
+				WithGroup("auth").With("kind", "basic", "token", "secret").
+				Info(testMessage)
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.wantGroup)
+			buf.Reset()
+
+			logger.WithGroup("req").
+				With("user", "a", "skip", 1, slog.Group("auth", "kind", "basic", "token", "secret")).
+				Info(testMessage,
+					"id", 1,
+					slog.Group("http", slog.Group("auth", "kind", "bearer", "token", "secret")),
+				)
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerExpandSlices(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts Options
+		want string
+	}{
+		{
+			name: "off",
+			want: `ids=\[1 2 3\] names=\[a b c \] arr=\[1 2\] empty=\[\] raw=\[1 2\]`,
+		},
+		{
+			name: "on",
+			opts: Options{ExpandSlices: true},
+			want: `ids=\[1,2,3\] names=\[a,"b c",""\] arr=\[1,2\] empty=\[\] raw=\[1 2\]`,
+		},
+		{
+			name: "quote all",
+			opts: Options{ExpandSlices: true, QuoteAllStrings: true},
+			want: `ids=\[1,2,3\] names=\["a","b c",""\] arr=\[1,2\] empty=\[\] raw=\[1 2\]`,
+		},
+		{
+			name: "needs quoting",
+			opts: Options{ExpandSlices: true, NeedsQuoting: func(s string) bool { return len(s) == 0 }},
+			want: `ids=\[1,2,3\] names=\[a,b c,""\] arr=\[1,2\] empty=\[\] raw=\[1 2\]`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			logger := slog.New(New(buf, &test.opts))
+
+			logger.Info(testMessage,
+				"ids", []int{1, 2, 3},
+				"names", []string{"a", "b c", ""},
+				"arr", [2]uint{1, 2},
+				"empty", []string(nil),
+				"raw", []byte{1, 2},
+			)
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerLevelPrefix(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		color bool
+		want  string
+	}{
+		{"plain", false, `>>> ERROR ` + testMessage + `~INFO ` + testMessage},
+		{"color", true, func() string {
+			if runtime.GOOS == "windows" {
+				return `>>> ERROR ` + testMessage + `~INFO ` + testMessage
+			}
+			return `>>> ` + testConsoleColorRed + `ERROR` + testConsoleColorReset + ` ` + testMessage +
+				`~` + testConsoleColorGreen + `INFO` + testConsoleColorReset + ` ` + testMessage
+		}()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:    newBoolBar(test.color),
+				DropTime:    true,
+				LevelPrefix: map[slog.Level]string{slog.LevelError: ">>> "},
+			}))
+
+			logger.Error(testMessage)
+			logger.Info(testMessage)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerUnitKeys(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+		UnitKeys: map[string]string{
+			"latency":   "ms",
+			"http.size": "B",
+		},
+	}))
+
+	logger.Info(testMessage, "latency", 23, "count", 2, slog.Group("http", "size", 512))
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` latency=23ms count=2 http.size=512B`)
+}
+
+func TestConsoleTextHandlerTrailingSeparator(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:          newBoolBar(false),
+		DropTime:          true,
+		TrailingSeparator: true,
+	}))
+
+	logger.Info(testMessage)
+	logger.Info(testMessage, "key", 1)
+
+	if want := "INFO " + testMessage + " \nINFO " + testMessage + " key=1 \n"; buf.String() != want {
+		t.Errorf("\ngot  %q\nwant %q", buf.String(), want)
+	}
+}
+
+func TestConsoleTextHandlerIncludePID(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:   newBoolBar(false),
+		DropTime:   true,
+		IncludePID: true,
+	}))
+
+	pid := strconv.Itoa(os.Getpid())
+	logger.Info(testMessage)
+	logger.WithGroup("grp").Info(testMessage, "key", 1)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` pid=`+pid+`~INFO `+testMessage+` pid=`+pid+` grp.key=1`)
+}
+
+func TestConsoleTextHandlerShowActiveGroup(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:        newBoolBar(false),
+		DropTime:        true,
+		ShowActiveGroup: true,
+	}))
+
+	logger.Info(testMessage)
+	logger.WithGroup("grp").Info(testMessage)
+	logger.WithGroup("grp").WithGroup("grp2").Info(testMessage, "key", 1)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+
+		`~INFO `+testMessage+` \[grp\]`+
+		`~INFO `+testMessage+` \[grp.grp2\] grp.grp2.key=1`)
+}
+
+func TestConsoleTextHandlerAttrTimeFormat(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		opts  *Options
+		attrs []slog.Attr
+		want  string
+	}{
+		{
+			name: "default",
+			opts: &Options{},
+			want: `2023-09-10 20:00:00.000 INFO ` + testMessage + ` at=2023-09-10 20:00:00.000`,
+		},
+		{
+			name: "record format",
+			opts: &Options{TimeFormat: time.Kitchen},
+			want: `8:00PM INFO ` + testMessage + ` at=8:00PM`,
+		},
+		{
+			name: "distinct",
+			opts: &Options{TimeFormat: time.Kitchen, AttrTimeFormat: time.RFC3339},
+			want: `8:00PM INFO ` + testMessage + ` at=2023-09-10T20:00:00Z`,
+		},
+		{
+			name:  "slice",
+			opts:  &Options{TimeFormat: time.Kitchen, ExpandSlices: true},
+			attrs: []slog.Attr{slog.Any("at", []time.Time{testTime, testTime.Add(time.Hour)})},
+			want:  `8:00PM INFO ` + testMessage + ` at=[8:00PM,9:00PM]`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			hd := New(buf, test.opts)
+
+			r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, 0)
+			if len(test.attrs) == 0 {
+				test.attrs = []slog.Attr{slog.Time("at", testTime)}
+			}
+			r.AddAttrs(test.attrs...)
+			if err := hd.Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+			checkLogOutput(t, buf.String(), regexp.QuoteMeta(test.want))
+
+			buf.Reset()
+		})
+	}
+}
+
+type requestIDKey struct{}
+
+func TestConsoleTextHandlerRequestID(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-42")
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{
+			name: "text",
+			opts: &Options{},
+			want: `INFO ` + testMessage + ` request_id=req-42 key=1 grp.n=2` +
+				`~INFO ` + testMessage + ` key=1 grp.n=2`,
+		},
+		{
+			name: "text attr",
+			opts: &Options{RequestIDAttr: "rid"},
+			want: `INFO ` + testMessage + ` rid=req-42 key=1 grp.n=2` +
+				`~INFO ` + testMessage + ` key=1 grp.n=2`,
+		},
+		{
+			name: "json",
+			opts: &Options{AttrsAsJSON: true},
+			want: `INFO ` + testMessage + ` \{"request_id":"req-42","key":1,"grp":\{"n":2\}\}` +
+				`~INFO ` + testMessage + ` \{"key":1,"grp":\{"n":2\}\}`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.RequestIDKey = requestIDKey{}
+
+			logger := slog.New(New(buf, test.opts)).With("key", 1).WithGroup("grp")
+			logger.InfoContext(ctx, testMessage, "n", 2)
+			logger.InfoContext(context.Background(), testMessage, "n", 2)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerColorBooleans(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		color bool
+		want  string
+	}{
+		{"plain", false, `INFO ` + testMessage + ` yes=true no=false none=<nil> n=1`},
+		{"color", true, func() string {
+			if runtime.GOOS == "windows" {
+				return `INFO ` + testMessage + ` yes=true no=false none=<nil> n=1`
+			}
+			return testConsoleColorGreen + `INFO` + testConsoleColorReset + ` ` + testMessage +
+				` yes=` + testConsoleColorGreen + `true` + testConsoleColorReset +
+				` no=` + testConsoleColorGray + `false` + testConsoleColorReset +
+				` none=` + testConsoleColorGray + `<nil>` + testConsoleColorReset +
+				` n=1`
+		}()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				ColorBooleans: true,
+				Colorize:      newBoolBar(test.color),
+				DropTime:      true,
+			}))
+
+			logger.Info(testMessage, "yes", true, "no", false, "none", nil, "n", 1)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestAppendValueUnknownKind(t *testing.T) {
+	unknown := slog.KindLogValuer + 1
+
+	if knownKind(unknown) {
+		t.Errorf("kind %d is known", unknown)
+	}
+	for _, k := range []slog.Kind{slog.KindAny, slog.KindBool, slog.KindLogValuer} {
+		if !knownKind(k) {
+			t.Errorf("kind %s is unknown", k)
+		}
+	}
+
+	// no panic, written with fmt
+	got := appendValueKind(unknown, slog.AnyValue([]int{1, 2}), nil)
+	if string(got) != "[1 2]" {
+		t.Errorf("got %q, want %q", got, "[1 2]")
+	}
+}
+
+func TestConsoleTextHandlerMergeDuplicateGroups(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		merge bool
+		want  string
+	}{
+		{"off", false, `a.k1=1 a.a.k2=2 a.a.b.b.a.k3=3`},
+		{"on", true, `a.k1=1 a.k2=2 a.b.a.k3=3`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:             newBoolBar(false),
+				DropTime:             true,
+				MergeDuplicateGroups: test.merge,
+			}))
+
+			logger.WithGroup("a").With("k1", 1).
+				WithGroup("a").With("k2", 2).
+				WithGroup("b").WithGroup("b").WithGroup("a").
+				Info(testMessage, "k3", 3)
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerLevelBadge(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		color bool
+		want  string
+	}{
+		{"plain", false, ` ERROR  ` + testMessage + `~ INFO   ` + testMessage + `~ ERROR\+4  ` + testMessage},
+		{"color", true, func() string {
+			if runtime.GOOS == "windows" {
+				return ` ERROR  ` + testMessage + `~ INFO   ` + testMessage + `~ ERROR\+4  ` + testMessage
+			}
+			return "\033\\[41m ERROR " + testConsoleColorReset + ` ` + testMessage +
+				"~\033\\[42m INFO  " + testConsoleColorReset + ` ` + testMessage +
+				"~\033\\[41m ERROR\\+4 " + testConsoleColorReset + ` ` + testMessage
+		}()},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:   newBoolBar(test.color),
+				DropTime:   true,
+				LevelBadge: true,
+			}))
+
+			logger.Error(testMessage)
+			logger.Info(testMessage)
+			logger.Log(context.Background(), slog.LevelError+4, testMessage)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerColorReset(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	const reset = "\033[39;49;22m"
+	const testReset = "\033\\[39;49;22m"
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{
+			name: "level",
+			opts: &Options{},
+			want: testConsoleColorGreen + `INFO` + testReset + ` ` + testMessage + ` ok=true`,
+		},
+		{
+			name: "badge",
+			opts: &Options{LevelBadge: true},
+			want: "\033\\[42m INFO  " + testReset + ` ` + testMessage + ` ok=true`,
+		},
+		{
+			name: "booleans",
+			opts: &Options{ColorBooleans: true},
+			want: testConsoleColorGreen + `INFO` + testReset + ` ` + testMessage +
+				` ok=` + testConsoleColorGreen + `true` + testReset,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(true)
+			test.opts.ColorReset = reset
+			test.opts.DropTime = true
+
+			slog.New(New(buf, test.opts)).Info(testMessage, "ok", true)
+			checkLogOutput(t, buf.String(), test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestNeedsQuoting(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want bool
+	}{
+		{"", true},
+		{"GET", false},
+		{"/api/v1/users", false},
+		{`C:\path`, false},
+		{"a b", true},
+		{"a=b", true},
+		{`a"b`, true},
+		{"a\nb", true},
+		{"a\tb", true},
+		{"a\x00b", true},
+		{"a\x7fb", true},
+		{"привет", false},
+		{"abc привет", true},
+		{"abc\u00a0def", true},
+		{"abc\u200bdef", true},
+		{"abc\xffdef", true},
+		{"abcпривет\n", true},
+	} {
+		if got := needsQuoting(tt.s); got != tt.want {
+			t.Errorf("needsQuoting(%q) = %t, want %t", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestConsoleTextHandlerZeroTime(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, opts := range []*Options{
+		{Colorize: newBoolBar(false)},
+		{Colorize: newBoolBar(false), TimeLast: true},
+	} {
+		r := slog.NewRecord(time.Time{}, slog.LevelInfo, testMessage, 0)
+		if err := New(buf, opts).Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+
+		checkLogOutput(t, buf.String(), `INFO `+testMessage)
+		buf.Reset()
+	}
+}
+
+func TestConsoleTextHandlerPalette256(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	palette := &PaletteVar{}
+	palette.Set(Palette256())
+
+	logger := slog.New(New(buf, &Options{
+		Colorize: newBoolBar(true),
+		DropTime: true,
+		Palette:  palette,
+	}))
+	logger.Info(testMessage)
+	logger.Error(testMessage)
+
+	checkLogOutput(t, buf.String(),
+		"\033\\[38;5;114mINFO"+testConsoleColorReset+` `+testMessage+
+			"~\033\\[38;5;196mERROR"+testConsoleColorReset+` `+testMessage)
+}
+
+func TestConsoleTextHandlerEscapeNewlinesInValues(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		val  string
+		want string
+	}{
+		{"line1\nline2\r\n", `out=line1\\nline2\\r\\n`},
+		{"line 1\nline 2", `out="line 1\\nline 2"`},
+		{"line1", `out=line1`},
+	} {
+		slog.New(New(buf, &Options{
+			Colorize:               newBoolBar(false),
+			DropTime:               true,
+			EscapeNewlinesInValues: true,
+		})).Info(testMessage, "out", test.val)
+
+		checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+		buf.Reset()
+	}
+}
+
+func TestStartupAttrs(t *testing.T) {
+	attrs := StartupAttrs()
+	if len(attrs) < 2 {
+		t.Fatalf("got %d attrs, want at least 2", len(attrs))
+	}
+	if v := attrs[0].Value.String(); attrs[0].Key != "go" || v != runtime.Version() {
+		t.Errorf("got %s, want go=%s", attrs[0], runtime.Version())
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	slog.New(New(buf, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+	}).WithAttrs(attrs)).Info(testMessage)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+
+		` go=`+regexp.QuoteMeta(runtime.Version())+
+		` platform=`+runtime.GOOS+`/`+runtime.GOARCH+`( build\.\w+=\S*)*`)
+}
+
+func TestStripColor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	colored := bytes.NewBuffer(make([]byte, 0, 1024))
+	stripped := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	slog.New(New(io.MultiWriter(colored, StripColor(stripped)), &Options{
+		ColorMode: ColorAlways,
+		DropTime:  true,
+	})).Info(testMessage, "key", testInt)
+
+	checkLogOutput(t, colored.String(), testConsoleColorGreen+`INFO`+testConsoleColorReset+
+		` `+testMessage+` key=`+strconv.Itoa(testInt))
+	checkLogOutput(t, stripped.String(), `INFO `+testMessage+` key=`+strconv.Itoa(testInt))
+}
+
+func TestConsoleTextHandlerMaxTotalBytes(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var rotated int
+	var hd *ConsoleHandler
+	hd = New(buf, &Options{
+		Colorize:      newBoolBar(false),
+		DropTime:      true,
+		MaxTotalBytes: 100,
+		OnRotate: func() {
+			rotated++
+			// new output after rotation
+			hd.SetOutput(buf)
+		},
+	})
+	logger := slog.New(hd)
+
+	// 65 bytes per line
+	for i := 0; i < 4; i++ {
+		logger.Info(testMessage)
+		if want := (i + 1) / 2; rotated != want {
+			t.Fatalf("line %d: got %d rotations, want %d", i+1, rotated, want)
+		}
+	}
+}
+
+func TestConsoleTextHandlerSortAttrs(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		mode SortMode
+		want string
+	}{
+		{"none", SortNone, `z=1 a-c=2 a.y=3 b=4 a.x=5 a.g.k=6`},
+		{"keys", SortKeys, `a-c=2 a.g.k=6 a.x=5 a.y=3 b=4 z=1`},
+		{"grouped", SortGrouped, `a.g.k=6 a.x=5 a.y=3 a-c=2 b=4 z=1`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			slog.New(New(buf, &Options{
+				Colorize:  newBoolBar(false),
+				DropTime:  true,
+				SortAttrs: test.mode,
+			})).With("z", 1, "a-c", 2, slog.Group("a", "y", 3)).Info(testMessage,
+				"b", 4, slog.Group("a", "x", 5, slog.Group("g", "k", 6)),
+			)
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` `+test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerLevelFormatChar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:    newBoolBar(true),
+		DropTime:    true,
+		Level:       slog.LevelDebug,
+		LevelFormat: LevelFormatChar,
+	}))
+	logger.Debug(testMessage)
+	logger.Info(testMessage)
+	logger.Warn(testMessage)
+	logger.Error(testMessage)
+
+	checkLogOutput(t, buf.String(),
+		testConsoleColorWhite+`D`+testConsoleColorReset+` `+testMessage+
+			`~`+testConsoleColorGreen+`I`+testConsoleColorReset+` `+testMessage+
+			`~`+testConsoleColorYellow+`W`+testConsoleColorReset+` `+testMessage+
+			`~`+testConsoleColorRed+`E`+testConsoleColorReset+` `+testMessage)
+}
+
+// writeCounter counts Write calls
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.writes++
+	return wc.Buffer.Write(p)
+}
+
+func TestConsoleTextHandlerStreaming(t *testing.T) {
+	want := bytes.NewBuffer(make([]byte, 0, 1024))
+	got := &writeCounter{}
+
+	value := strings.Repeat("x", 200)
+	attrs := make([]any, 0, 100)
+	for i := 0; i < cap(attrs); i++ {
+		attrs = append(attrs, slog.String("key"+strconv.Itoa(i), value))
+	}
+
+	for _, w := range []io.Writer{want, got} {
+		slog.New(New(w, &Options{
+			Colorize:  newBoolBar(false),
+			DropTime:  true,
+			Streaming: w == got,
+		})).With("static", value).Info(testMessage, attrs...)
+	}
+
+	if got.String() != want.String() {
+		t.Errorf("streamed line differs:\ngot  %q\nwant %q", got.String(), want.String())
+	}
+	if got.writes < 2 {
+		t.Errorf("got %d writes, want chunks", got.writes)
+	}
+}
+
+func TestConsoleTextHandlerStreamingPanic(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var logger *slog.Logger
+	logger = slog.New(New(buf, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			switch a.Key {
+			case "panic":
+				panic(a.Value.String())
+			case "log":
+				// the handler is called again from the callback
+				logger.Info("inner")
+			}
+			return a
+		},
+		Streaming: true,
+	}))
+
+	func() {
+		defer func() { _ = recover() }()
+		// the first chunk is written before the panic
+		logger.Info(testMessage, "big", strings.Repeat("x", 8<<10), "panic", "boom")
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.Info(testMessage, "log", 1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mutex is left locked")
+	}
+
+	if !strings.HasSuffix(buf.String(), "INFO inner\nINFO "+testMessage+" log=1\n") {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestConsoleTextHandlerAddSource(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	slog.New(New(buf, &Options{
+		AddSource: true,
+		Colorize:  newBoolBar(false),
+		DropTime:  true,
+	})).Info(testMessage)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` source=\S+/handler_test\.go:[1-9]\d*`)
+
+	// source is at the top level under WithGroup, as slog does
+	buf.Reset()
+	slog.New(New(buf, &Options{
+		AddSource: true,
+		Colorize:  newBoolBar(false),
+		DropTime:  true,
+	})).WithGroup("g").Info(testMessage, "k", 1)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` source=\S+/handler_test\.go:[1-9]\d* g\.k=1`)
+
+	// no program counter
+	buf.Reset()
+	r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, 0)
+	if err := New(buf, &Options{
+		AddSource: true,
+		Colorize:  newBoolBar(false),
+		DropTime:  true,
+	}).Handle(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	checkLogOutput(t, buf.String(), `INFO `+testMessage)
+}
+
+func TestConsoleTextHandlerContinuationPrefix(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name   string
+		opts   *Options
+		prefix string
+		want   string
+	}{
+		{
+			name:   "multiline",
+			opts:   &Options{MultiLine: true},
+			prefix: "  | ",
+			want:   `~  \| a    =1~  \| req.b=2`,
+		},
+		{
+			name:   "blocks",
+			opts:   &Options{GroupBlocks: true},
+			prefix: "  | ",
+			want:   ` a=1~  \| req:~  \|   b=2`,
+		},
+		{
+			name: "no indentation",
+			opts: &Options{MultiLine: true},
+			want: `~a    =1~req.b=2`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.ContinuationPrefix = &test.prefix
+			test.opts.DropTime = true
+
+			slog.New(New(buf, test.opts)).Info(testMessage, "a", 1, slog.Group("req", "b", 2))
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.want)
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerShortSource(t *testing.T) {
+	full := bytes.NewBuffer(make([]byte, 0, 1024))
+	short := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, pcs[0])
+
+	for _, w := range []*bytes.Buffer{full, short} {
+		if err := New(w, &Options{
+			AddSource:   true,
+			Colorize:    newBoolBar(false),
+			DropTime:    true,
+			ShortSource: w == short,
+		}).Handle(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkLogOutput(t, full.String(), `INFO `+testMessage+` source=\S+/handler_test\.go:[1-9]\d*`)
+	checkLogOutput(t, short.String(), `INFO `+testMessage+` source=handler_test\.go:[1-9]\d*`)
+
+	_, line, _ := strings.Cut(strings.TrimSpace(full.String()), ".go:")
+	if !strings.HasSuffix(strings.TrimSpace(short.String()), ".go:"+line) {
+		t.Errorf("got %q, want the same line as %q", short.String(), full.String())
+	}
+
+	// ShortSource without AddSource
+	short.Reset()
+	if err := New(short, &Options{
+		Colorize:    newBoolBar(false),
+		DropTime:    true,
+		ShortSource: true,
+	}).Handle(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	checkLogOutput(t, short.String(), `INFO `+testMessage)
+}
+
+func TestConsoleTextHandlerMessageTemplate(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:        newBoolBar(false),
+		DropTime:        true,
+		MessageTemplate: true,
+	}))
+
+	for _, test := range []struct {
+		msg  string
+		args []any
+		want string
+	}{
+		{
+			msg:  "User {user} logged in from {ip}",
+			args: []any{"user", "John Smith", "ip", "10.0.0.1", "n", 1},
+			want: `User John Smith logged in from 10.0.0.1 n=1`,
+		},
+		{
+			msg:  "User {user} logged in {times} times",
+			args: []any{"user", "bob", "n", 1},
+			want: `User bob logged in \{times\} times n=1`,
+		},
+		{
+			msg:  "Took {elapsed} at {",
+			args: []any{"elapsed", testDuration},
+			want: `Took ` + testDuration.String() + ` at \{`,
+		},
+		{
+			msg:  "Group {req}",
+			args: []any{slog.Group("req", "id", 1)},
+			want: `Group \{req\} req.id=1`,
+		},
+	} {
+		logger.Info(test.msg, test.args...)
+		checkLogOutput(t, buf.String(), `INFO `+test.want)
+
+		buf.Reset()
+	}
+}
+
+func TestConsoleTextHandlerSourceFunction(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	slog.New(New(buf, &Options{
+		AddSource:      true,
+		Colorize:       newBoolBar(false),
+		DropTime:       true,
+		ShortSource:    true,
+		SourceFunction: true,
+	})).Info(testMessage)
+
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+
+		` source="github\.com/supar/slog-console\.TestConsoleTextHandlerSourceFunction \(handler_test\.go:[1-9]\d*\)"`)
+}
+
+func TestConsoleTextHandlerOnKeyCollision(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-42")
+
+	for _, test := range []struct {
+		name   string
+		policy KeyCollisionPolicy
+		want   string
+	}{
+		{"keep", KeyCollisionKeep, ` request_id=req-42 source=\S+ request_id=attr source=attr grp.source=grp`},
+		{"suffix", KeyCollisionSuffix, ` request_id=req-42 source=\S+ request_id_1=attr source_1=attr grp.source=grp`},
+		{"skip", KeyCollisionSkip, ` request_id=req-42 source=\S+ grp.source=grp`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			slog.New(New(buf, &Options{
+				AddSource:      true,
+				Colorize:       newBoolBar(false),
+				DropTime:       true,
+				OnKeyCollision: test.policy,
+				RequestIDKey:   requestIDKey{},
+				ShortSource:    true,
+			})).InfoContext(ctx, testMessage,
+				"request_id", "attr",
+				"source", "attr",
+				slog.Group("grp", "source", "grp"),
+			)
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerOnKeyCollisionKeyed(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name   string
+		format Format
+		policy KeyCollisionPolicy
+		want   string
+	}{
+		{"json keep", FormatJSON, KeyCollisionKeep, `{"level":"INFO","msg":"hello","msg":"w","msg":"x","level":"y"}`},
+		{"json suffix", FormatJSON, KeyCollisionSuffix, `{"level":"INFO","msg":"hello","msg_1":"w","msg_1":"x","level_1":"y"}`},
+		{"json skip", FormatJSON, KeyCollisionSkip, `{"level":"INFO","msg":"hello"}`},
+		{"logfmt keep", FormatLogfmt, KeyCollisionKeep, `level=info msg=hello msg=w msg=x level=y`},
+		{"logfmt suffix", FormatLogfmt, KeyCollisionSuffix, `level=info msg=hello msg_1=w msg_1=x level_1=y`},
+		{"logfmt skip", FormatLogfmt, KeyCollisionSkip, `level=info msg=hello`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			slog.New(New(buf, &Options{
+				DropTime:       true,
+				Format:         test.format,
+				OnKeyCollision: test.policy,
+			})).With("msg", "w").Info("hello", "msg", "x", "level", "y")
+
+			if got, want := buf.String(), test.want+"\n"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			buf.Reset()
+		})
+	}
+
+	// the time key is reserved unless DropTime is on
+	slog.New(New(buf, &Options{
+		Format:         FormatJSON,
+		OnKeyCollision: KeyCollisionSkip,
+	})).With("time", 1).Info("hello", "time", 2)
+
+	if got := buf.String(); strings.Count(got, `"time"`) != 1 {
+		t.Errorf("got %q, want a single time", got)
+	}
+}
+
+func TestConsoleTextHandlerSourceTrimPrefix(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	f, _ := runtime.CallersFrames(pcs[:]).Next()
+	r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, pcs[0])
+
+	for _, test := range []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"match", path.Dir(f.File), `handler_test\.go`},
+		{"match slash", path.Dir(f.File) + "/", `handler_test\.go`},
+		{"no match", "/nonexistent", regexp.QuoteMeta(f.File)},
+		{"partial dir", strings.TrimSuffix(f.File, "handler_test.go") + "handler", regexp.QuoteMeta(f.File)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := New(buf, &Options{
+				AddSource:        true,
+				Colorize:         newBoolBar(false),
+				DropTime:         true,
+				SourceTrimPrefix: test.prefix,
+			}).Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+` source=`+test.want+`:`+strconv.Itoa(f.Line))
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerColorizeLine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:      newBoolBar(true),
+		ColorizeLine:  true,
+		ColorBooleans: true,
+	}))
+	logger.Warn(testMessage, "key", testInt)
+	logger.Info(testMessage, "ok", true)
+
+	checkLogOutput(t, buf.String(),
+		testConsoleColorYellow+timeRE+` WARN `+testMessage+` key=`+strconv.Itoa(testInt)+testConsoleColorReset+
+			`~`+testConsoleColorGreen+timeRE+` INFO `+testMessage+
+			` ok=`+testConsoleColorGreen+`true`+testConsoleColorReset+testConsoleColorGreen+testConsoleColorReset)
+
+	if !strings.HasSuffix(buf.String(), ConsoleColorReset+"\n") {
+		t.Errorf("got %q, want reset before the new line", buf.String())
+	}
+}
+
+func TestConsoleTextHandlerSortPreformatted(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"text", &Options{}, ` b=1 c=2 a=3 z=4 grp.x=6 grp.y=5 grp.r2=8 grp.r1=7`},
+		{"json", &Options{AttrsAsJSON: true}, ` \{"b":1,"c":2,"a":3,"z":4,"grp":\{"x":6,"y":5,"r2":8,"r1":7\}\}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.SortPreformatted = true
+
+			attrs := []slog.Attr{slog.Int("c", 2), slog.Int("b", 1)}
+			slog.New(New(buf, test.opts).WithAttrs(attrs)).
+				With("z", 4, "a", 3).
+				WithGroup("grp").With("y", 5, "x", 6).
+				Info(testMessage, "r2", 8, "r1", 7)
+
+			checkLogOutput(t, buf.String(), `INFO `+testMessage+test.want)
+			if attrs[0].Key != "c" {
+				t.Error("WithAttrs argument is sorted")
+			}
+			buf.Reset()
+		})
+	}
+}
+
+// fakeWidth reports the terminal width
+type fakeWidth struct {
+	bytes.Buffer
+	width int
+}
+
+func (fw *fakeWidth) Width() int { return fw.width }
+
+func TestConsoleTextHandlerAutoWidth(t *testing.T) {
+	w := &fakeWidth{width: 30}
+
+	hd := New(w, &Options{
+		AutoWidth: true,
+		Colorize:  newBoolBar(false),
+		DropTime:  true,
+	})
+	if n := hd.Width(); n != 30 {
+		t.Fatalf("got width %d, want 30", n)
+	}
+
+	logger := slog.New(hd.WithAttrs([]slog.Attr{slog.String("user", "bob")}))
+	logger.Info("short", "status", 200, "path", "/api/v1/users", "n", 1)
+
+	checkLogOutput(t, w.String(), `INFO short user=bob status=200`+
+		`~  path=/api/v1/users n=1`)
+
+	// re-detected for the new writer
+	hd.SetOutput(&bytes.Buffer{})
+	if n := hd.Width(); n != defaultWidth {
+		t.Errorf("got width %d, want %d", n, defaultWidth)
+	}
+}
+
+func TestConsoleTextHandlerColors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	colors := DefaultPalette()
+	colors.Info = ConsoleColorCyan
+
+	logger := slog.New(New(buf, &Options{
+		Colorize: newBoolBar(true),
+		Colors:   &colors,
+		DropTime: true,
+	}))
+	logger.Info(testMessage)
+	logger.Warn(testMessage)
+
+	checkLogOutput(t, buf.String(),
+		testConsoleColorCyan+`INFO`+testConsoleColorReset+` `+testMessage+
+			`~`+testConsoleColorYellow+`WARN`+testConsoleColorReset+` `+testMessage)
+}
+
+func TestIsTerminal(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, test := range []struct {
+		name string
+		w    io.Writer
+		want bool
+	}{
+		{"fake terminal", new(fakeTerminal), true},
+		{"buffer", new(bytes.Buffer), false},
+		{"file", f, false},
+		{"stripped", StripColor(new(fakeTerminal)), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTerminal(test.w); got != test.want {
+				t.Errorf("got %t, want %t", got, test.want)
+			}
+
+			t.Setenv("NO_COLOR", "")
+			t.Setenv("FORCE_COLOR", "")
+			if got := New(test.w, nil).ColorEnabled(); got != test.want && runtime.GOOS != "windows" {
+				t.Errorf("got color %t, want %t", got, test.want)
+			}
+		})
+	}
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer null.Close()
+
+		if isTerminal(null) {
+			t.Errorf("%s is a terminal", os.DevNull)
+		}
+	}
+}
+
+func TestConsoleTextHandlerForceColor(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("FORCE_COLOR", "1")
+
+	// windows too
+	slog.New(New(buf, &Options{DropTime: true})).Info(testMessage)
+	checkLogOutput(t, buf.String(), testConsoleColorGreen+`INFO`+testConsoleColorReset+` `+testMessage)
+}
+
+func TestEnableVT(t *testing.T) {
+	// only windows consoles need it
+	want := runtime.GOOS != "windows"
+	if got := enableVT(new(bytes.Buffer)); got != want {
+		t.Errorf("got %t for a buffer, want %t", got, want)
+	}
+
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("FORCE_COLOR", "")
+	hd := New(new(bytes.Buffer), &Options{Colorize: newBoolBar(true)})
+	if got := hd.ColorEnabled(); got != want {
+		t.Errorf("got color %t, want %t", got, want)
+	}
+}
+
+func TestColorHelpers(t *testing.T) {
+	for _, test := range []struct {
+		got, want string
+	}{
+		{Color256(0), "\033[38;5;0m"},
+		{Color256(255), "\033[38;5;255m"},
+		{RGB(255, 128, 0), "\033[38;2;255;128;0m"},
+		{RGB(0, 0, 0), "\033[38;2;0;0;0m"},
+	} {
+		if test.got != test.want {
+			t.Errorf("got %q, want %q", test.got, test.want)
+		}
+	}
+}
+
+func TestConsoleTextHandlerTrueColor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	colors := DefaultPalette()
+	colors.Info = RGB(255, 128, 0)
+
+	slog.New(New(buf, &Options{
+		Colorize:      newBoolBar(true),
+		ColorBooleans: true,
+		Colors:        &colors,
+		DropTime:      true,
+	})).Info(testMessage, "ok", false)
+
+	// each color is reset
+	checkLogOutput(t, buf.String(), "\033\\[38;2;255;128;0mINFO"+testConsoleColorReset+` `+testMessage+
+		` ok=`+testConsoleColorGray+`false`+testConsoleColorReset)
+}
+
+func TestConsoleTextHandlerKeyValueColor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{
+			name: "both",
+			opts: &Options{KeyColor: ConsoleColorCyan, ValueColor: ConsoleColorPurple},
+			want: ` ` + testConsoleColorCyan + `key` + testConsoleColorReset + `=` +
+				testConsoleColorPurple + `1ms` + testConsoleColorReset,
+		},
+		{
+			name: "key",
+			opts: &Options{KeyColor: ConsoleColorCyan},
+			want: ` ` + testConsoleColorCyan + `key` + testConsoleColorReset + `=1ms`,
+		},
+		{
+			name: "value",
+			opts: &Options{ValueColor: ConsoleColorPurple},
+			want: ` key=` + testConsoleColorPurple + `1ms` + testConsoleColorReset,
+		},
+		{
+			name: "multiline",
+			opts: &Options{KeyColor: ConsoleColorCyan, ValueColor: ConsoleColorPurple, MultiLine: true},
+			want: `~  ` + testConsoleColorCyan + `key` + testConsoleColorReset + `=` +
+				testConsoleColorPurple + `1ms` + testConsoleColorReset,
+		},
+		{
+			name: "no color",
+			opts: &Options{KeyColor: ConsoleColorCyan, ValueColor: ConsoleColorPurple, Colorize: newBoolBar(false)},
+			want: ` key=1ms`,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opts.Colorize == nil {
+				test.opts.Colorize = newBoolBar(true)
+			}
+			test.opts.DropTime = true
+			test.opts.LevelFormat = LevelFormatChar
+			test.opts.UnitKeys = map[string]string{"key": "ms"}
+
+			slog.New(New(buf, test.opts)).Info(testMessage, "key", 1)
+
+			checkLogOutput(t, stripLevel(buf.String()), testMessage+test.want)
+			buf.Reset()
+		})
+	}
+}
+
+// stripLevel removes the colored or plain level word
+func stripLevel(s string) string {
+	_, rest, _ := strings.Cut(s, " ")
+	return rest
+}
+
+func TestConsoleTextHandlerTimeColor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	lvI := testConsoleColorGreen + `I` + testConsoleColorReset
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"default", &Options{}, testConsoleColorDarkGray + timeRE + testConsoleColorReset + ` ` + lvI + ` ` + testMessage},
+		{"custom", &Options{TimeColor: ConsoleColorBlue}, testConsoleColorBlue + timeRE + testConsoleColorReset + ` ` + lvI + ` ` + testMessage},
+		{"time last", &Options{TimeLast: true}, lvI + ` ` + testMessage + ` ` + testConsoleColorDarkGray + timeRE + testConsoleColorReset},
+		{"drop time", &Options{DropTime: true}, lvI + ` ` + testMessage},
+		{"no color", &Options{Colorize: newBoolBar(false)}, timeRE + ` I ` + testMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opts.Colorize == nil {
+				test.opts.Colorize = newBoolBar(true)
+			}
+			test.opts.LevelFormat = LevelFormatChar
+
+			slog.New(New(buf, test.opts)).Info(testMessage)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerBoldLevel(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"bold", &Options{BoldLevel: true}, testConsoleBold + testConsoleColorRed + `ERROR` + testConsoleColorReset + ` ` + testMessage},
+		{"not bold", &Options{}, testConsoleColorRed + `ERROR` + testConsoleColorReset + ` ` + testMessage},
+		{"no color", &Options{BoldLevel: true, Colorize: newBoolBar(false)}, `ERROR ` + testMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opts.Colorize == nil {
+				test.opts.Colorize = newBoolBar(true)
+			}
+			test.opts.DropTime = true
+
+			slog.New(New(buf, test.opts)).Error(testMessage)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerLevelWidth(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug, `DEBUG ` + testMessage},
+		{slog.LevelInfo, `INFO  ` + testMessage},
+		{slog.LevelWarn, `WARN  ` + testMessage},
+		{slog.LevelError, `ERROR ` + testMessage},
+	} {
+		t.Run(test.level.String(), func(t *testing.T) {
+			logger := slog.New(New(buf, &Options{
+				Colorize:   newBoolBar(false),
+				DropTime:   true,
+				Level:      slog.LevelDebug,
+				LevelWidth: 5,
+			}))
+			logger.Log(context.Background(), test.level, testMessage)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+
+	t.Run("colored", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("colors are off on windows")
+		}
+
+		logger := slog.New(New(buf, &Options{
+			Colorize:   newBoolBar(true),
+			DropTime:   true,
+			LevelWidth: 5,
+		}))
+		logger.Info(testMessage)
+
+		checkLogOutput(t, buf.String(), testConsoleColorGreen+`INFO `+testConsoleColorReset+` `+testMessage)
+		buf.Reset()
+	})
+}
+
+func TestConsoleTextHandlerAbbreviatedLevels(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		level slog.Level
+		opts  *Options
+		want  string
+	}{
+		{slog.LevelDebug, &Options{}, `DBG ` + testMessage},
+		{slog.LevelInfo, &Options{}, `INF ` + testMessage},
+		{slog.LevelWarn, &Options{}, `WRN ` + testMessage},
+		{slog.LevelError, &Options{}, `ERR ` + testMessage},
+		{slog.LevelError + 4, &Options{}, `ERR\+4 ` + testMessage},
+		{slog.LevelInfo - 2, &Options{}, `DBG\+2 ` + testMessage},
+		{slog.LevelError + 4, &Options{LevelFormat: LevelFormatNameNum}, `ERR\+4\(12\) ` + testMessage},
+		{slog.LevelWarn, &Options{StringLevel: func(slog.Level) string { return "warning" }}, `warning ` + testMessage},
+	} {
+		t.Run(test.level.String(), func(t *testing.T) {
+			test.opts.AbbreviatedLevels = true
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.Level = slog.LevelDebug
+
+			slog.New(New(buf, test.opts)).Log(context.Background(), test.level, testMessage)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerExtendedLevels(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		level slog.Level
+		opts  *Options
+		want  string
+	}{
+		{LevelTrace, &Options{ExtendedLevels: true}, `TRACE ` + testMessage},
+		{LevelTrace + 2, &Options{ExtendedLevels: true}, `TRACE\+2 ` + testMessage},
+		{LevelTrace - 1, &Options{ExtendedLevels: true}, `TRACE-1 ` + testMessage},
+		{slog.LevelDebug, &Options{ExtendedLevels: true}, `DEBUG ` + testMessage},
+		{slog.LevelError + 2, &Options{ExtendedLevels: true}, `ERROR\+2 ` + testMessage},
+		{LevelFatal, &Options{ExtendedLevels: true}, `FATAL ` + testMessage},
+		{LevelFatal + 1, &Options{ExtendedLevels: true}, `FATAL\+1 ` + testMessage},
+		{LevelFatal, &Options{ExtendedLevels: true, AbbreviatedLevels: true}, `FTL ` + testMessage},
+		{LevelTrace, &Options{ExtendedLevels: true, LevelFormat: LevelFormatNameNum}, `TRACE\(-8\) ` + testMessage},
+		{LevelFatal, &Options{}, `ERROR\+4 ` + testMessage},
+	} {
+		t.Run(test.level.String(), func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.Level = LevelTrace - 1
+
+			slog.New(New(buf, test.opts)).Log(context.Background(), test.level, testMessage)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+
+	t.Run("colors", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("colors are off on windows")
+		}
+
+		logger := slog.New(New(buf, &Options{
+			Colorize:       newBoolBar(true),
+			DropTime:       true,
+			ExtendedLevels: true,
+			Level:          LevelTrace,
+		}))
+
+		logger.Log(context.Background(), LevelTrace, testMessage)
+		checkLogOutput(t, buf.String(), testConsoleColorWhite+`TRACE`+testConsoleColorReset+` `+testMessage)
+		buf.Reset()
+
+		logger.Log(context.Background(), LevelFatal, testMessage)
+		checkLogOutput(t, buf.String(), testConsoleColorRed+`FATAL`+testConsoleColorReset+` `+testMessage)
+		buf.Reset()
+	})
+}
+
+func TestConsoleTextHandlerExitLevel(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var codes []int
+	osExit = func(code int) {
+		// the line is written before the exit
+		if !strings.HasSuffix(buf.String(), "last\n") {
+			t.Error("exit before write")
+		}
+		codes = append(codes, code)
+	}
+	defer func() { osExit = os.Exit }()
+
+	exitLevel := slog.LevelError
+	for _, async := range []bool{false, true} {
+		codes = nil
+		h := New(buf, &Options{
+			AsyncWrite: async,
+			Colorize:   newBoolBar(false),
+			ExitCode:   3,
+			ExitLevel:  &exitLevel,
+		})
+		logger := slog.New(h)
+
+		logger.Info(testMessage)
+		logger.Warn(testMessage)
+		if len(codes) != 0 {
+			t.Fatalf("async %v: exit below ExitLevel with %v", async, codes)
+		}
+
+		logger.Error("last")
+		logger.Log(context.Background(), LevelFatal, "last")
+		if !slices.Equal(codes, []int{3, 3}) {
+			t.Fatalf("async %v: got exit codes %v, want [3 3]", async, codes)
+		}
+		h.Close()
+		buf.Reset()
+	}
+
+	// no ExitLevel
+	codes = nil
+	slog.New(New(buf, &Options{Colorize: newBoolBar(false)})).Log(context.Background(), LevelFatal, "last")
+	if len(codes) != 0 {
+		t.Fatalf("got exit codes %v without ExitLevel", codes)
+	}
+}
+
+func TestConsoleTextHandlerLevelIcons(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:    newBoolBar(true),
+		DropTime:    true,
+		Level:       LevelTrace,
+		LevelPrefix: LevelIcons(),
+	}))
+
+	for _, test := range []struct {
+		level slog.Level
+		want  string
+	}{
+		{slog.LevelDebug, "\U0001f41b " + testConsoleColorWhite + `DEBUG`},
+		{slog.LevelWarn, "⚠️ " + testConsoleColorYellow + `WARN`},
+		{slog.LevelError, "❌ " + testConsoleColorRed + `ERROR`},
+		{slog.LevelError + 2, testConsoleColorRed + `ERROR\+2`},
+		{LevelTrace, testConsoleColorWhite + `DEBUG-4`},
+	} {
+		t.Run(test.level.String(), func(t *testing.T) {
+			if runtime.GOOS == "windows" {
+				t.Skip("colors are off on windows")
+			}
+
+			logger.Log(context.Background(), test.level, testMessage)
+			checkLogOutput(t, buf.String(), test.want+testConsoleColorReset+` `+testMessage)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerUTC(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	tm := testTime.In(time.FixedZone("UTC+3", 3*60*60))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"local", &Options{}, `2023-09-10 23:00:00\.000 INFO ` + testMessage},
+		{"utc", &Options{UTC: true}, `2023-09-10 20:00:00\.000 INFO ` + testMessage},
+		{"format", &Options{UTC: true, TimeFormat: time.RFC3339}, `2023-09-10T20:00:00Z INFO ` + testMessage},
+		{"drop time", &Options{UTC: true, DropTime: true}, `INFO ` + testMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+
+			r := slog.NewRecord(tm, slog.LevelInfo, testMessage, 0)
+			if err := New(buf, test.opts).Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerElapsedTime(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	timeNow = func() time.Time { return testTime }
+	defer func() { timeNow = time.Now }()
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		tm   time.Time
+		want string
+	}{
+		{"start", &Options{}, testTime, `\+0\.000s INFO ` + testMessage},
+		{"elapsed", &Options{}, testTime.Add(1234 * time.Millisecond), `\+1\.234s INFO ` + testMessage},
+		{"minutes", &Options{}, testTime.Add(2*time.Minute + 5*time.Millisecond), `\+120\.005s INFO ` + testMessage},
+		{"before", &Options{}, testTime.Add(-1500 * time.Millisecond), `-1\.500s INFO ` + testMessage},
+		{"format", &Options{TimeFormat: time.RFC3339, UTC: true}, testTime.Add(time.Second), `\+1\.000s INFO ` + testMessage},
+		{"drop time", &Options{DropTime: true}, testTime.Add(time.Second), `INFO ` + testMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.ElapsedTime = true
+
+			r := slog.NewRecord(test.tm, slog.LevelInfo, testMessage, 0)
+			if err := New(buf, test.opts).Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerUnixTime(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		tm   time.Time
+		want string
+	}{
+		{"seconds", &Options{}, testTime, `1694376000\.000 INFO ` + testMessage},
+		{"millis", &Options{}, testTime.Add(1234*time.Millisecond + time.Microsecond), `1694376001\.234 INFO ` + testMessage},
+		{"zone", &Options{TimeFormat: time.Kitchen}, testTime.In(time.FixedZone("UTC+3", 3*60*60)).Add(7 * time.Millisecond), `1694376000\.007 INFO ` + testMessage},
+		{"before epoch", &Options{}, time.Unix(-2, -500*int64(time.Millisecond)), `-2\.500 INFO ` + testMessage},
+		{"drop time", &Options{DropTime: true}, testTime, `INFO ` + testMessage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.UnixTime = true
+
+			r := slog.NewRecord(test.tm, slog.LevelInfo, testMessage, 0)
+			if err := New(buf, test.opts).Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerFormatJSON(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	h := New(buf, &Options{
+		AddSource:    true,
+		Colorize:     newBoolBar(true),
+		Format:       FormatJSON,
+		MultiLine:    true,
+		ShortSource:  true,
+		TimeFormat:   time.Kitchen,
+		RequestIDKey: requestIDKey{},
+	})
+	logger := slog.New(h).With("app", "test").WithGroup("grp").With("id", 7)
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-42")
+	logger.InfoContext(ctx, "line\n\"quoted\"",
+		"str", testString,
+		"dur", time.Second,
+		"ok", true,
+		slog.Group("sub", "f", 1.5),
+		"err", testError,
+	)
+
+	out := buf.String()
+	if !strings.HasSuffix(out, "}\n") || strings.Count(out, "\n") != 1 {
+		t.Fatalf("got %q, want a single JSON line", out)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("unmarshal %q: %v", out, err)
+	}
+
+	if _, err := time.Parse(time.RFC3339Nano, got["time"].(string)); err != nil {
+		t.Errorf("time: %v", err)
+	}
+	if src, _ := got["source"].(string); !strings.HasPrefix(src, "handler_test.go:") {
+		t.Errorf("got source %q", src)
+	}
+	delete(got, "time")
+	delete(got, "source")
+
+	want := map[string]any{
+		"level":      "INFO",
+		"msg":        "line\n\"quoted\"",
+		"request_id": "req-42",
+		"app":        "test",
+		"grp.id":     float64(7),
+		"grp.str":    testString,
+		"grp.dur":    "1s",
+		"grp.ok":     true,
+		"grp.sub.f":  1.5,
+		"grp.err":    testError.Error(),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestConsoleTextHandlerFormatJSONDropTime(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	slog.New(New(buf, &Options{Format: FormatJSON, DropTime: true})).Warn("")
+
+	if got, want := buf.String(), `{"level":"WARN","msg":""}`+"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerFormatJSONSortAttrs(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		DedupKeys: true,
+		DropTime:  true,
+		Format:    FormatJSON,
+		SortAttrs: SortKeys,
+	})).With("z", 1, "b", 1).WithGroup("grp")
+
+	logger.Info("", "y", 2, "a", 2, "y", 3)
+
+	want := `{"level":"INFO","msg":"","b":1,"grp.a":2,"grp.y":3,"z":1}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// parseLogfmt splits the logfmt line to key and unquoted value pairs
+func parseLogfmt(line string) ([][2]string, error) {
+	var kvs [][2]string
+	for len(line) > 0 {
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok || len(key) == 0 || strings.ContainsAny(key, " \"") {
+			return nil, fmt.Errorf("bad key at %q", line)
+		}
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			q, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("bad value at %q: %w", rest, err)
+			}
+			val, _ = strconv.Unquote(q)
+			rest = rest[len(q):]
+		} else {
+			val, rest, _ = strings.Cut(rest, " ")
+			rest = " " + rest
+			if strings.ContainsAny(val, "=\"") {
+				return nil, fmt.Errorf("unquoted value %q", val)
+			}
+		}
+
+		kvs = append(kvs, [2]string{key, val})
+		if len(rest) > 0 && rest[0] != ' ' {
+			return nil, fmt.Errorf("no separator at %q", rest)
+		}
+		line = strings.TrimPrefix(rest, " ")
+	}
+
+	return kvs, nil
+}
+
+func TestConsoleTextHandlerFormatLogfmt(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(buf, &Options{
+		Colorize:     newBoolBar(true),
+		ExpandSlices: true,
+		Format:       FormatLogfmt,
+		MultiLine:    true,
+		UTC:          true,
+	})).With("app", "my app").WithGroup("grp")
+
+	r := slog.NewRecord(testTime, slog.LevelWarn, `say "hi" a=b`, 0)
+	r.AddAttrs(
+		slog.String("str", testString),
+		slog.String("eq", "a=b"),
+		slog.String("empty", ""),
+		slog.Int("n", 7),
+		slog.Any("err", testError),
+		slog.Time("at", testTime),
+		slog.Any("list", []string{"a", "b c"}),
+		slog.Group("sub", slog.String("nl", "a\nb")),
+	)
+	if err := logger.Handler().Handle(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.HasSuffix(out, "\n") || strings.Count(out, "\n") != 1 {
+		t.Fatalf("got %q, want a single line", out)
+	}
+	got, err := parseLogfmt(strings.TrimSuffix(out, "\n"))
+	if err != nil {
+		t.Fatalf("parse %q: %v", out, err)
+	}
+
+	want := [][2]string{
+		{"time", "2023-09-10T20:00:00.000Z"},
+		{"level", "warn"},
+		{"msg", `say "hi" a=b`},
+		{"app", "my app"},
+		{"grp.str", testString},
+		{"grp.eq", "a=b"},
+		{"grp.empty", ""},
+		{"grp.n", "7"},
+		{"grp.err", testError.Error()},
+		{"grp.at", "2023-09-10T20:00:00.000Z"},
+		{"grp.list", `[a,"b c"]`},
+		{"grp.sub.nl", "a\nb"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerFormatLogfmtDropTime(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	slog.New(New(buf, &Options{Format: FormatLogfmt, DropTime: true})).Error("")
+
+	if got, want := buf.String(), `level=error msg=""`+"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerAlignAttrs(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"inline", &Options{}, `INFO ` + testMessage + ` app    =test a      =1 grp.bcd=2 grp.ok =true`},
+		{"sorted", &Options{SortAttrs: SortKeys}, `INFO ` + testMessage + ` a      =1 app    =test grp.bcd=2 grp.ok =true`},
+		{"wrapped", &Options{AutoWidth: true}, `INFO ` + testMessage + ` app    =test~  a      =1 grp.bcd=2 grp.ok =true`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.AlignAttrs = true
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+
+			w := &fakeWidth{width: 80}
+			logger := slog.New(New(w, test.opts)).With("app", "test")
+			logger.Info(testMessage, "a", 1, slog.Group("grp", "bcd", 2, "ok", true))
+
+			checkLogOutput(t, w.String(), test.want)
+		})
+	}
+}
+
+func TestConsoleTextHandlerTemplate(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"reordered", &Options{Template: "{level} {time} {msg} {attrs}"}, `INFO ` + timeRE + ` ` + testMessage + ` app=test n=1`},
+		{"minimal", &Options{Template: "{level} {msg}"}, `INFO ` + testMessage},
+		{"separators", &Options{Template: "[{level}] {msg} | {attrs}", DropTime: true}, `\[INFO\] ` + testMessage + ` \| app=test n=1`},
+		{"drop time", &Options{Template: "{time} {level}: {msg}", DropTime: true}, `INFO: ` + testMessage},
+		{"trailing", &Options{Template: "{msg};{level};"}, testMessage + `;INFO;`},
+		{"source", &Options{Template: "{source} {msg}", AddSource: true}, `source=\S+handler_test.go:\d+ ` + testMessage},
+		{"no source", &Options{Template: "{msg} {source} {level}"}, testMessage + ` INFO`},
+		{"multi-line", &Options{Template: "{msg} {level} {attrs}", MultiLine: true}, testMessage + ` INFO~  app=test~  n  =1`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+
+			slog.New(New(buf, test.opts)).With("app", "test").Info(testMessage, "n", 1)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	for _, test := range []struct {
+		tmpl string
+		err  string
+	}{
+		{"{time} {level} {msg} {source} {attrs}", ""},
+		{"plain", ""},
+		{"{level} {message}", `unknown placeholder "{message}"`},
+		{"{level} {msg", `unterminated placeholder "{msg"`},
+	} {
+		err := ValidateTemplate(test.tmpl)
+		if got := fmt.Sprint(err); err == nil && len(test.err) > 0 || err != nil && got != test.err {
+			t.Errorf("%q: got error %v, want %q", test.tmpl, err, test.err)
+		}
+	}
+
+	// the invalid template falls back to the default layout
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	slog.New(New(buf, &Options{Colorize: newBoolBar(false), DropTime: true, Template: "{lvl}"})).Info(testMessage, "n", 1)
+	checkLogOutput(t, buf.String(), `INFO `+testMessage+` n=1`)
+}
+
+func TestNewFromHandlerOptions(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(NewFromHandlerOptions(buf, &slog.HandlerOptions{
+		AddSource: true,
+		Level:     slog.LevelWarn,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == "secret" {
+				a.Value = slog.StringValue("***")
+			}
+			return a
+		},
+	}))
+
+	logger.Info(testMessage)
+	logger.Warn(testMessage, "secret", "pass")
+
+	checkLogOutput(t, stripANSI(buf.String()), timeRE+` WARN `+testMessage+` source=\S+handler_test.go:\d+ secret=\*\*\*`)
+
+	buf.Reset()
+	slog.New(NewFromHandlerOptions(buf, nil)).Debug(testMessage)
+	if buf.Len() > 0 {
+		t.Fatalf("got %q with nil options", buf.String())
+	}
+}
+
+func TestConsoleTextHandlerSetLevel(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name  string
+		level slog.Leveler
+	}{
+		{"default", nil},
+		{"level var", new(slog.LevelVar)},
+		{"plain level", slog.LevelDebug},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := New(buf, &Options{
+				Colorize: newBoolBar(false),
+				DropTime: true,
+				Level:    test.level,
+			})
+			h.SetLevel(slog.LevelDebug)
+			logger := slog.New(h)
+			derived := logger.With("app", "test")
+
+			logger.Debug(testMessage)
+			h.SetLevel(slog.LevelInfo)
+			logger.Debug(testMessage)
+			derived.Debug(testMessage)
+			derived.Info(testMessage)
+
+			checkLogOutput(t, buf.String(), `DEBUG `+testMessage+`~INFO `+testMessage+` app=test`)
+			buf.Reset()
+		})
+	}
+
+	lv := new(slog.LevelVar)
+	New(io.Discard, &Options{Level: lv}).SetLevel(slog.LevelError)
+	if lv.Level() != slog.LevelError {
+		t.Fatalf("got LevelVar %v, want ERROR", lv.Level())
+	}
+}
+
+func TestConsoleTextHandlerSetColorize(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("colors are off on windows")
+	}
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("FORCE_COLOR", "")
+
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, opts := range []*Options{
+		{Colorize: newBoolBar(false)},
+		{},
+		{ColorMode: ColorNever},
+	} {
+		opts.DropTime = true
+		hd := New(buf, opts)
+		logger := slog.New(hd)
+
+		logger.Info(testMessage)
+		hd.SetColorize(true)
+		logger.Info(testMessage)
+		hd.SetColorize(false)
+		logger.Info(testMessage)
+
+		checkLogOutput(t, buf.String(), `INFO `+testMessage+
+			`~`+testConsoleColorGreen+`INFO`+testConsoleColorReset+` `+testMessage+
+			`~INFO `+testMessage)
+		buf.Reset()
+	}
+
+	// no-op
+	hd := New(buf, &Options{Colorize: constBool(false), DropTime: true})
+	hd.SetColorize(true)
+	slog.New(hd).Info(testMessage)
+	checkLogOutput(t, buf.String(), `INFO `+testMessage)
+	buf.Reset()
+
+	hd = New(buf, &Options{Format: FormatLogfmt, DropTime: true, KeyColor: ConsoleColorCyan})
+	hd.SetColorize(true)
+	slog.New(hd).Info("msg", "a", 1)
+	checkLogOutput(t, buf.String(), `level=info msg=msg a=1`)
+}
+
+func TestConsoleTextHandlerWriterFor(t *testing.T) {
+	out := bytes.NewBuffer(make([]byte, 0, 1024))
+	errOut := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	logger := slog.New(New(out, &Options{
+		Colorize: newBoolBar(false),
+		DropTime: true,
+		WriterFor: func(lv slog.Level) io.Writer {
+			if lv >= slog.LevelWarn {
+				return errOut
+			}
+			return nil
+		},
+	})).With("app", "test")
+
+	logger.Info(testMessage)
+	logger.Warn(testMessage)
+	logger.Error(testMessage)
+	logger.Debug(testMessage)
+
+	checkLogOutput(t, out.String(), `INFO `+testMessage+` app=test`)
+	checkLogOutput(t, errOut.String(), `WARN `+testMessage+` app=test~ERROR `+testMessage+` app=test`)
+}
+
+func TestConsoleTextHandlerReplaceSourceInGroup(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, format := range []Format{FormatText, FormatJSON} {
+		var groups [][]string
+		slog.New(New(buf, &Options{
+			AddSource:      true,
+			Colorize:       newBoolBar(false),
+			DropTime:       true,
+			Format:         format,
+			OnKeyCollision: KeyCollisionSkip,
+			ReplaceAttr: func(g []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.SourceKey {
+					groups = append(groups, g)
+					if len(g) == 0 {
+						a.Value = slog.StringValue("here")
+					}
+				}
+				return a
+			},
+		})).WithGroup("g").Info(testMessage, "source", "attr")
+
+		// the built-in source and the attribute of the group
+		if len(groups) != 2 || groups[0] != nil || !slices.Equal(groups[1], []string{"g"}) {
+			t.Errorf("format %v: got groups %q", format, groups)
+		}
+
+		got := buf.String()
+		buf.Reset()
+		if format == FormatJSON {
+			if want := `"source":"here","g.source":"attr"`; !strings.Contains(got, want) {
+				t.Errorf("got %q", got)
+			}
+			continue
+		}
+		checkLogOutput(t, got, `INFO `+testMessage+` source=here g\.source=attr`)
+	}
+}
+
+func TestConsoleTextHandlerReplaceBuiltins(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	replace := func(key string, v slog.Value) func([]string, slog.Attr) slog.Attr {
+		return func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == key && groups == nil {
+				a.Value = v
+			}
+			return a
+		}
+	}
+	drop := func(key string) func([]string, slog.Attr) slog.Attr {
+		return func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == key && groups == nil {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	rename := func(groups []string, a slog.Attr) slog.Attr {
+		if groups == nil {
+			switch a.Key {
+			case slog.TimeKey:
+				a.Key = "ts"
+			case slog.LevelKey:
+				a.Key = "severity"
+			case slog.MessageKey:
+				a.Key = "message"
+			}
+		}
+		return a
+	}
+
+	for _, test := range []struct {
+		name    string
+		opts    *Options
+		replace func([]string, slog.Attr) slog.Attr
+		want    string
+	}{
+		{"time", &Options{}, replace(slog.TimeKey, slog.TimeValue(testTime.Add(time.Hour))), `2023-09-10 21:00:00\.000 INFO ` + testMessage + ` a=1`},
+		{"time text", &Options{}, replace(slog.TimeKey, slog.StringValue("now")), `now INFO ` + testMessage + ` a=1`},
+		{"level", &Options{}, replace(slog.LevelKey, slog.AnyValue(slog.LevelWarn)), `2023-09-10 20:00:00\.000 WARN ` + testMessage + ` a=1`},
+		{"level text", &Options{}, replace(slog.LevelKey, slog.StringValue("notice")), `2023-09-10 20:00:00\.000 notice ` + testMessage + ` a=1`},
+		{"msg", &Options{}, replace(slog.MessageKey, slog.StringValue("hello")), `2023-09-10 20:00:00\.000 INFO hello a=1`},
+		{"source", &Options{AddSource: true}, replace(slog.SourceKey, slog.StringValue("here")), `2023-09-10 20:00:00\.000 INFO ` + testMessage + ` source=here a=1`},
+		{"drop time", &Options{}, drop(slog.TimeKey), `INFO ` + testMessage + ` a=1`},
+		{"drop level", &Options{}, drop(slog.LevelKey), `2023-09-10 20:00:00\.000 ` + testMessage + ` a=1`},
+		{"drop msg", &Options{}, drop(slog.MessageKey), `2023-09-10 20:00:00\.000 INFO a=1`},
+		{"drop source", &Options{AddSource: true}, drop(slog.SourceKey), `2023-09-10 20:00:00\.000 INFO ` + testMessage + ` a=1`},
+		{"text keys", &Options{}, rename, `2023-09-10 20:00:00\.000 INFO ` + testMessage + ` a=1`},
+		{"logfmt keys", &Options{Format: FormatLogfmt}, rename, `ts=2023-09-10T20:00:00\.000Z severity=info message="` + testMessage + `" a=1`},
+		{"json keys", &Options{Format: FormatJSON}, rename, regexp.QuoteMeta(`{"ts":"2023-09-10T20:00:00Z","severity":"INFO","message":"` + testMessage + `","a":1}`)},
+		{"json drop", &Options{Format: FormatJSON}, drop(slog.LevelKey), regexp.QuoteMeta(`{"time":"2023-09-10T20:00:00Z","msg":"` + testMessage + `","a":1}`)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.ReplaceAttr = test.replace
+
+			pcs := make([]uintptr, 1)
+			runtime.Callers(1, pcs)
+			r := slog.NewRecord(testTime, slog.LevelInfo, testMessage, pcs[0])
+			r.AddAttrs(slog.Int("a", 1))
+			if err := New(buf, test.opts).Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+
+	// all built-ins dropped
+	slog.New(New(buf, &Options{
+		Format: FormatJSON,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if groups == nil && a.Key != "a" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})).With("a", 1).Info(testMessage)
+	if got, want := buf.String(), `{"a":1}`+"\n"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerReplaceAttrGroups(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	var seen []string
+	replace := func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey {
+			return a
+		}
+		seen = append(seen, strings.Join(append(slices.Clone(groups), a.Key), "/"))
+		// secret is hidden inside of grp only
+		if a.Key == "secret" && len(groups) > 0 && groups[len(groups)-1] == "grp" {
+			a.Value = slog.StringValue("***")
+		}
+		// the group may be rewritten
+		if a.Key == "old" && a.Value.Kind() == slog.KindGroup {
+			a.Key = "new"
+		}
+		return a
+	}
+
+	for _, format := range []Format{FormatText, FormatJSON} {
+		seen = nil
+		logger := slog.New(New(buf, &Options{
+			Colorize:    newBoolBar(false),
+			DropTime:    true,
+			Format:      format,
+			ReplaceAttr: replace,
+		}))
+
+		logger.Info(testMessage,
+			"secret", "top",
+			slog.Group("grp", "secret", "inner", slog.Group("sub", "secret", "deep")),
+			slog.Group("old", "k", 1),
+		)
+		logger.WithGroup("grp").Info(testMessage, "secret", "with", slog.Group("x", "secret", "x"))
+		logger.WithGroup("grp").With(slog.Group("", "secret", "inline")).Info(testMessage)
+
+		want := []string{
+			"secret", "grp", "grp/secret", "grp/sub", "grp/sub/secret", "old", "new/k",
+			"grp/secret", "grp/x", "grp/x/secret",
+			"grp/", "grp/secret",
+		}
+		if !slices.Equal(seen, want) {
+			t.Errorf("format %v: got groups\n%q\nwant\n%q", format, seen, want)
+		}
+
+		got := buf.String()
+		buf.Reset()
+		if format == FormatJSON {
+			continue
+		}
+		checkLogOutput(t, got, `INFO `+testMessage+` secret=top grp.secret=\*\*\* grp.sub.secret=deep new.k=1`+
+			`~INFO `+testMessage+` grp.secret=\*\*\* grp.x.secret=x`+
+			`~INFO `+testMessage+` grp.secret=\*\*\*`)
+	}
+}
+
+func TestConsoleTextHandlerDedupKeys(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"inline", &Options{}, `INFO ` + testMessage + ` a=3 grp.k=1 k=2~INFO ` + testMessage + ` k=1 a=2 grp.b=2 grp.k=3`},
+		{"sorted", &Options{SortAttrs: SortKeys}, `INFO ` + testMessage + ` a=3 grp.k=1 k=2~INFO ` + testMessage + ` a=2 grp.b=2 grp.k=3 k=1`},
+		{"logfmt", &Options{Format: FormatLogfmt}, `level=info msg="` + testMessage + `" a=3 grp.k=1 k=2~level=info msg="` + testMessage + `" k=1 a=2 grp.b=2 grp.k=3`},
+		{"group blocks", &Options{GroupBlocks: true}, `INFO ` + testMessage + ` a=3 k=2~  grp:~    k=1~INFO ` + testMessage + ` k=1 a=2~  grp:~    b=2~    k=3`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DedupKeys = true
+			test.opts.DropTime = true
+
+			logger := slog.New(New(buf, test.opts)).With("a", 1, "k", 1, "a", 2)
+			// preformatted and record collisions
+			logger.Info(testMessage, "a", 3, slog.Group("grp", "k", 1), "k", 2)
+			logger.WithGroup("grp").With("b", 1, "k", 2).Info(testMessage, "b", 2, "k", 3)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerDropLevel(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"text", &Options{}, `msg a=1`},
+		{"empty message", &Options{}, `a=1`},
+		{"source", &Options{AddSource: true, ShortSource: true}, `msg source=handler_test.go:\d+ a=1`},
+		{"time last", &Options{TimeLast: true}, `msg a=1`},
+		{"logfmt", &Options{Format: FormatLogfmt}, `msg=msg a=1`},
+		{"json", &Options{Format: FormatJSON}, regexp.QuoteMeta(`{"msg":"msg","a":1}`)},
+		{"template", &Options{Template: "{level} {msg} {attrs}"}, `msg a=1`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropLevel = true
+			test.opts.DropTime = true
+			test.opts.ReplaceAttr = func(_ []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey {
+					t.Error("ReplaceAttr is called for the dropped level")
+				}
+				return a
+			}
+
+			msg := "msg"
+			if test.name == "empty message" {
+				msg = ""
+			}
+			slog.New(New(buf, test.opts)).Warn(msg, "a", 1)
+
+			checkLogOutput(t, buf.String(), test.want)
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerSeparators(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"inline", &Options{}, "INFO\tmsg\tapp:test\tgrp.k:1\tgrp.s:\"a b\"\n"},
+		{"sorted", &Options{SortAttrs: SortKeys}, "INFO\tmsg\tapp:test\tgrp.k:1\tgrp.s:\"a b\"\n"},
+		{"aligned", &Options{AlignAttrs: true}, "INFO\tmsg\tapp  :test\tgrp.k:1\tgrp.s:\"a b\"\n"},
+		{"multi-line", &Options{MultiLine: true}, "INFO\tmsg\n  app  :test\n  grp.k:1\n  grp.s:\"a b\"\n"},
+		{"trailing", &Options{TrailingSeparator: true}, "INFO\tmsg\tapp:test\tgrp.k:1\tgrp.s:\"a b\"\t\n"},
+		{"logfmt", &Options{Format: FormatLogfmt}, "level=info msg=msg app=test grp.k=1 grp.s=\"a b\"\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.FieldSeparator = "\t"
+			test.opts.KVSeparator = ":"
+
+			slog.New(New(buf, test.opts)).With("app", "test").WithGroup("grp").Info("msg", "k", 1, "s", "a b")
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerQuoteAllStrings(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"text", &Options{}, `INFO msg app="test" s="hello" n=1 sp="a b" nl="a\nb"` + "\n"},
+		{"escaped newlines", &Options{EscapeNewlinesInValues: true}, `INFO msg app="test" s="hello" n=1 sp="a b" nl="a\nb"` + "\n"},
+		{"logfmt", &Options{Format: FormatLogfmt}, `level=info msg=msg app="test" s="hello" n=1 sp="a b" nl="a\nb"` + "\n"},
+		{"json", &Options{Format: FormatJSON}, `{"level":"INFO","msg":"msg","app":"test","s":"hello","n":1,"sp":"a b","nl":"a\nb"}` + "\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+			test.opts.QuoteAllStrings = true
+
+			slog.New(New(buf, test.opts)).With("app", "test").Info("msg", "s", "hello", "n", 1, "sp", "a b", "nl", "a\nb")
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerNeedsQuoting(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	commas := func(s string) bool { return strings.ContainsRune(s, ',') }
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"default", &Options{}, `INFO msg app=test list=a,b sp="a b" e=""` + "\n"},
+		{"commas", &Options{NeedsQuoting: commas}, `INFO msg app=test list="a,b" sp=a b e=` + "\n"},
+		{"never", &Options{NeedsQuoting: func(string) bool { return false }}, `INFO msg app=test list=a,b sp=a b e=` + "\n"},
+		{"quote all", &Options{NeedsQuoting: commas, QuoteAllStrings: true}, `INFO msg app="test" list="a,b" sp="a b" e=""` + "\n"},
+		{"logfmt", &Options{Format: FormatLogfmt, NeedsQuoting: commas}, `level=info msg=msg app=test list="a,b" sp=a b e=` + "\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+
+			slog.New(New(buf, test.opts)).With("app", "test").Info("msg", "list", "a,b", "sp", "a b", "e", "")
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			buf.Reset()
+		})
+	}
+}
+
+func TestConsoleTextHandlerEscapeMessageNewlines(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	escape := newBoolBar(true)
+	for _, test := range []struct {
+		name string
+		opts *Options
+		want string
+	}{
+		{"default", &Options{}, `INFO line1\nline2\r\nline3 a=1` + "\n"},
+		{"template", &Options{Template: "{msg} {level}"}, `line1\nline2\r\nline3 INFO` + "\n"},
+		{"var", &Options{EscapeMessageNewlines: escape}, `INFO line1\nline2\r\nline3 a=1` + "\n"},
+		{"logfmt", &Options{Format: FormatLogfmt}, `level=info msg="line1\nline2\r\nline3" a=1` + "\n"},
+		{"json", &Options{Format: FormatJSON}, `{"level":"INFO","msg":"line1\nline2\r\nline3","a":1}` + "\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.opts.Colorize = newBoolBar(false)
+			test.opts.DropTime = true
+
+			slog.New(New(buf, test.opts)).Info("line1\nline2\r\nline3", "a", 1)
+
+			if got := buf.String(); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			buf.Reset()
+		})
+	}
+
+	// turned off concurrently
+	escape.Set(false)
+	slog.New(New(buf, &Options{Colorize: newBoolBar(false), DropTime: true, EscapeMessageNewlines: escape})).Info("a\nb")
+	if got, want := buf.String(), "INFO a\nb\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleTextHandlerEnableVT(t *testing.T) {
+	var enabled []io.Writer
+	consoleVT = func(w io.Writer) bool {
+		enabled = append(enabled, w)
+		return true
+	}
+	defer func() { consoleVT = enableVT }()
+
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	for _, opts := range []*Options{
+		{ColorMode: ColorNever},
+		{Colorize: newBoolBar(false)},
+		{Colorize: newBoolBar(true), Format: FormatJSON},
+		{Colorize: newBoolBar(true), Format: FormatLogfmt},
+	} {
+		slog.New(New(out, opts)).Info(testMessage)
+	}
+	if len(enabled) > 0 {
+		t.Fatalf("enabled for the uncolored output: %v", enabled)
+	}
+
+	colorize := newBoolBar(false)
+	h := NewSplit(out, errOut, &Options{Colorize: colorize})
+	slog.New(h).Info(testMessage)
+	if len(enabled) > 0 {
+		t.Fatal("enabled before the colors are on")
+	}
+
+	// both writers once the colors are on
+	colorize.Set(true)
+	slog.New(h).Info(testMessage)
+	slog.New(h).Info(testMessage)
+	if len(enabled) != 2 || enabled[0] != out || enabled[1] != errOut {
+		t.Fatalf("got enabled %d writers, want stdout and stderr", len(enabled))
+	}
+
+	// the new writer and the kept stderr
+	enabled = nil
+	out2 := &bytes.Buffer{}
+	h.SetOutput(out2)
+	slog.New(h).Info(testMessage)
+	if len(enabled) != 2 || enabled[0] != out2 || enabled[1] != errOut {
+		t.Fatalf("got enabled %d writers, want the new stdout and stderr", len(enabled))
+	}
+}
@@ -0,0 +1,315 @@
+package slogconsole
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// jsonOptions turns off the text options not used by FormatJSON
+func jsonOptions(opts Options) Options {
+	opts.Colorize = constBool(false)
+	opts.EscapeMessageNewlines = constBool(false)
+
+	opts.AlignAttrs = false
+	opts.AttrsAsJSON = false
+	opts.AutoWidth = false
+	opts.GroupBlocks = false
+	opts.HashChain = false
+	opts.MultiLine = false
+	opts.TrailingSeparator = false
+
+	return opts
+}
+
+// appendJSONRecord writes the record as a single JSON object, the attribute
+// keys have the group prefix, see FormatJSON
+func (c *composer) appendJSONRecord(ctx context.Context, r slog.Record) {
+	c.buf.writeByte('{')
+	if !r.Time.IsZero() && !c.h.opts.DropTime {
+		tm := slog.StringValue(c.timeText)
+		if len(c.timeText) == 0 {
+			if tm = slog.TimeValue(r.Time); c.h.opts.UTC {
+				tm = slog.TimeValue(r.Time.UTC())
+			}
+		}
+		c.appendJSONField(c.timeKey, tm)
+		c.reserved = append(c.reserved, c.timeKey)
+	}
+	if len(c.levelKey) > 0 {
+		lvStr := c.levelText
+		if len(lvStr) == 0 {
+			lvStr = c.optionalStringLevel(r.Level, false)
+		}
+		c.appendJSONField(c.levelKey, slog.StringValue(lvStr))
+		c.reserved = append(c.reserved, c.levelKey)
+	}
+	if len(c.msgKey) > 0 {
+		c.appendJSONField(c.msgKey, slog.StringValue(r.Message))
+		c.reserved = append(c.reserved, c.msgKey)
+	}
+
+	if c.h.opts.AddSource && r.PC != 0 {
+		a := c.optionalReplaceAttr(nil, slog.String(slog.SourceKey, c.h.source(r.PC)))
+		if len(a.Key) > 0 {
+			c.appendJSONField(a.Key, a.Value.Resolve())
+			c.reserved = append(c.reserved, a.Key)
+		}
+	}
+	// request id from the context
+	if rid := c.h.requestID(ctx); len(rid.Key) > 0 {
+		c.appendJSONField(rid.Key, rid.Value.Resolve())
+		c.reserved = append(c.reserved, rid.Key)
+	}
+
+	if c.collect {
+		c.fields = append(c.fields, c.h.prefields...)
+		if r.NumAttrs() > 0 {
+			r.Attrs(c.walkAttrs)
+		}
+		c.arrangeFields()
+		for _, f := range c.fields {
+			c.appendJSONKeyValue(f.key, f.val)
+		}
+		c.buf.writeByte('}')
+		return
+	}
+
+	// the preformatted fields start with the comma
+	if pf := c.h.preformatted; len(pf) > 0 && (*c.buf)[c.bufLen()-1] == '{' {
+		c.buf.write(pf[1:])
+	} else {
+		c.buf.write(pf)
+	}
+	if r.NumAttrs() > 0 {
+		r.Attrs(c.walkAttrs)
+	}
+	c.buf.writeByte('}')
+}
+
+// appendJSONField writes "key":value of the flat JSON object with the comma
+// before it if needed
+func (c *composer) appendJSONField(key string, v slog.Value) {
+	c.appendJSONKeyValue(key, "")
+	*c.buf = appendJSONValue(v, *c.buf)
+}
+
+// appendJSONKeyValue writes "key":val with the comma before it if needed,
+// val is JSON already
+func (c *composer) appendJSONKeyValue(key, val string) {
+	if n := c.bufLen(); n == 0 || (*c.buf)[n-1] != '{' {
+		c.buf.writeByte(',')
+	}
+	*c.buf = appendJSONString(*c.buf, key)
+	c.buf.writeByte(':')
+	c.buf.writeString(val)
+}
+
+// appendJSONAttrs writes handler preformatted and record attributes as a
+// single JSON object. Groups set with WithGroup become nested objects.
+// Non-empty lead attribute goes first out of groups
+func (c *composer) appendJSONAttrs(r slog.Record, lead slog.Attr) {
+	if len(c.h.preformatted) == 0 && r.NumAttrs() == 0 && len(lead.Key) == 0 {
+		return
+	}
+
+	start := c.bufLen()
+	c.addSpace(start > 0)
+	c.buf.writeByte('{')
+	brace := c.bufLen()
+	if len(lead.Key) > 0 {
+		c.appendJSONKey(lead.Key)
+		*c.buf = appendJSONValue(lead.Value.Resolve(), *c.buf)
+		if len(c.h.preformatted) > 0 {
+			c.buf.writeByte(',')
+		}
+	}
+	c.buf.write(c.h.preformatted)
+
+	c.jsonGroups = append(c.jsonGroups[:0], c.h.groups[c.h.openGroups:]...)
+	if r.NumAttrs() > 0 {
+		r.Attrs(func(a slog.Attr) bool {
+			c.appendJSONAttr(a)
+			return true
+		})
+	}
+
+	// nothing is written
+	if c.bufLen() == brace {
+		*c.buf = (*c.buf)[:start]
+		return
+	}
+	for opened := len(c.h.groups) - len(c.jsonGroups); opened > 0; opened-- {
+		c.buf.writeByte('}')
+	}
+	c.buf.writeByte('}')
+}
+
+// openJSONGroups opens the pending groups before the first attribute written
+// in them, so the groups without attributes are omitted as slog does
+func (c *composer) openJSONGroups() {
+	for _, g := range c.jsonGroups {
+		c.appendJSONKey(g)
+		c.buf.writeByte('{')
+	}
+	c.jsonGroups = c.jsonGroups[:0]
+}
+
+func (c *composer) appendJSONKey(key string) {
+	if b := (*c.buf)[c.bufLen()-1]; b != '{' {
+		c.buf.writeByte(',')
+	}
+	*c.buf = appendJSONString(*c.buf, key)
+	c.buf.writeByte(':')
+}
+
+func (c *composer) appendJSONAttr(a slog.Attr) {
+	// Resolve the Attr's value before doing anything else.
+	a.Value = a.Value.Resolve()
+	a = c.optionalReplaceAttr(c.groups(), a)
+	// Ignore empty Attrs.
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() != slog.KindGroup && !c.includeAttr(a) {
+		return
+	}
+
+	a.Key = c.optionalKeyTransform(a.Key)
+
+	if a.Value.Kind() != slog.KindGroup {
+		c.openJSONGroups()
+		c.appendJSONKey(a.Key)
+		*c.buf = appendJSONValue(a.Value, *c.buf)
+		return
+	}
+
+	attrs := a.Value.Group()
+	// Ignore empty groups.
+	if len(attrs) == 0 {
+		return
+	}
+
+	// inline group with empty key
+	if len(a.Key) == 0 {
+		for _, ga := range attrs {
+			c.appendJSONAttr(ga)
+		}
+		return
+	}
+
+	pending := len(c.jsonGroups)
+	c.jsonGroups = append(c.jsonGroups, a.Key)
+	c.pushGroup(a.Key)
+	for _, ga := range attrs {
+		c.appendJSONAttr(ga)
+	}
+	c.popGroup(a.Key)
+	if len(c.jsonGroups) > pending {
+		// no attribute is written
+		c.jsonGroups = c.jsonGroups[:pending]
+		return
+	}
+	c.buf.writeByte('}')
+}
+
+func appendJSONValue(v slog.Value, dst []byte) []byte {
+	switch v.Kind() {
+	case slog.KindString:
+		return appendJSONString(dst, v.String())
+	case slog.KindInt64:
+		return strconv.AppendInt(dst, v.Int64(), 10)
+	case slog.KindUint64:
+		return strconv.AppendUint(dst, v.Uint64(), 10)
+	case slog.KindFloat64:
+		// json has neither NaN nor Inf
+		b, err := json.Marshal(v.Float64())
+		if err != nil {
+			return appendJSONString(dst, err.Error())
+		}
+		return append(dst, b...)
+	case slog.KindBool:
+		return strconv.AppendBool(dst, v.Bool())
+	case slog.KindDuration:
+		return appendJSONString(dst, v.Duration().String())
+	case slog.KindTime:
+		return appendJSONString(dst, v.Time().Format(time.RFC3339Nano))
+	default:
+		if err, ok := v.Any().(error); ok {
+			return appendJSONString(dst, err.Error())
+		}
+
+		b, err := json.Marshal(v.Any())
+		if err != nil {
+			return appendJSONString(dst, string(appendValue(v, nil)))
+		}
+		return append(dst, b...)
+	}
+}
+
+func (h *ConsoleHandler) withJSONAttrs(attrs []slog.Attr) *ConsoleHandler {
+	h2 := *h
+
+	cm := newComposer(h)
+	defer cm.destruct()
+
+	// leading brace makes appendJSONKey separators right, it is not stored
+	cm.buf.writeByte('{')
+	cm.buf.write(h.preformatted)
+	cm.jsonGroups = append(cm.jsonGroups[:0], h.groups[h.openGroups:]...)
+
+	for _, a := range attrs {
+		cm.appendJSONAttr(a)
+	}
+	// the groups are opened by the first attribute
+	h2.openGroups = len(h.groups) - len(cm.jsonGroups)
+
+	h2.preformatted = make([]byte, cm.bufLen()-1)
+	copy(h2.preformatted, (*cm.buf)[1:])
+
+	return &h2
+}
+
+// Adapted from log/slog/json_handler.go
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			i++
+			if b == ' ' || safeSet[b] {
+				dst = append(dst, b)
+				continue
+			}
+
+			switch b {
+			case '\\', '"':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, `\ufffd`...)
+		} else {
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+
+	return append(dst, '"')
+}
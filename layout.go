@@ -0,0 +1,135 @@
+package slogconsole
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// layoutField is the placeholder of Options.Template
+type layoutField int
+
+const (
+	layoutText layoutField = iota
+	layoutTime
+	layoutLevel
+	layoutMsg
+	layoutSource
+	layoutAttrs
+)
+
+var layoutFields = map[string]layoutField{
+	"{time}":   layoutTime,
+	"{level}":  layoutLevel,
+	"{msg}":    layoutMsg,
+	"{source}": layoutSource,
+	"{attrs}":  layoutAttrs,
+}
+
+// layoutPart is the placeholder or the text between placeholders
+type layoutPart struct {
+	field layoutField
+	text  string
+}
+
+// ValidateTemplate reports the error of the Options.Template line layout.
+// New falls back to the default layout on the error, so call it up front
+func ValidateTemplate(tmpl string) error {
+	_, err := parseLayout(tmpl)
+	return err
+}
+
+func parseLayout(tmpl string) ([]layoutPart, error) {
+	var parts []layoutPart
+	for len(tmpl) > 0 {
+		i := strings.IndexByte(tmpl, '{')
+		if i < 0 {
+			parts = append(parts, layoutPart{text: tmpl})
+			break
+		}
+		if i > 0 {
+			parts = append(parts, layoutPart{text: tmpl[:i]})
+		}
+
+		j := strings.IndexByte(tmpl[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated placeholder %q", tmpl[i:])
+		}
+		name := tmpl[i : i+j+1]
+		field, ok := layoutFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder %q", name)
+		}
+		parts = append(parts, layoutPart{field: field})
+		tmpl = tmpl[i+j+1:]
+	}
+
+	return parts, nil
+}
+
+// appendLayout writes the record in the order of Options.Template. The text
+// after the empty placeholder is dropped, e.g. the space of "{time} {level}"
+// with DropTime, as well as the text before the part starting on the new line
+func (c *composer) appendLayout(ctx context.Context, r slog.Record) {
+	var sep string
+	skip := false
+	for _, p := range c.h.layout {
+		if p.field == layoutText {
+			if !skip {
+				sep = p.text
+			}
+			skip = false
+			continue
+		}
+
+		// the field is composed alone, so it doesn't start with the space
+		line := c.buf
+		c.buf = allocBuf()
+		c.appendLayoutField(ctx, r, p.field)
+		part := c.buf
+		c.buf = line
+
+		if len(*part) == 0 {
+			skip = true
+		} else {
+			// no trailing spaces before the MultiLine fields
+			if (*part)[0] != '\n' {
+				c.buf.writeString(sep)
+			}
+			// the timestamp position is of the part
+			if p.field == layoutTime && c.stamp.end > 0 {
+				c.stamp.start += c.bufLen()
+				c.stamp.end += c.bufLen()
+			}
+			c.buf.write(*part)
+			sep, skip = "", false
+		}
+		part.free()
+	}
+
+	if !skip {
+		c.buf.writeString(sep)
+	}
+}
+
+func (c *composer) appendLayoutField(ctx context.Context, r slog.Record, field layoutField) {
+	switch field {
+	case layoutTime:
+		c.appendTime(r.Time)
+	case layoutLevel:
+		c.appendLevel(r.Level)
+	case layoutMsg:
+		c.buf.writeString(r.Message)
+	case layoutSource:
+		c.appendSource(r.PC)
+	case layoutAttrs:
+		// request id from the context
+		rid := c.h.requestID(ctx)
+		if len(rid.Key) > 0 && !c.h.opts.AttrsAsJSON {
+			c.appendKeyValue(rid.Key, rid.Key, rid.Value.Resolve())
+			c.reserved = append(c.reserved, rid.Key)
+		}
+		c.appendRecordAttrs(r, rid)
+	}
+}
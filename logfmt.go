@@ -0,0 +1,99 @@
+package slogconsole
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// logfmtOptions turns off the text options not used by FormatLogfmt
+func logfmtOptions(opts Options) Options {
+	opts.Colorize = constBool(false)
+	opts.EscapeMessageNewlines = constBool(false)
+
+	opts.AlignAttrs = false
+	opts.AttrsAsJSON = false
+	opts.AutoWidth = false
+	opts.GroupBlocks = false
+	opts.MultiLine = false
+
+	opts.FieldSeparator = defaultFieldSeparator
+	opts.KVSeparator = defaultKVSeparator
+
+	return opts
+}
+
+// appendLogfmtRecord writes the record with the time, level and message as
+// key=value pairs, see FormatLogfmt
+func (c *composer) appendLogfmtRecord(ctx context.Context, r slog.Record) {
+	if !r.Time.IsZero() && !c.h.opts.DropTime {
+		c.buf.writeString(c.timeKey)
+		c.buf.writeByte('=')
+		start := c.bufLen()
+		if len(c.timeText) > 0 {
+			c.buf.writeString(c.timeText)
+		} else {
+			c.appendTimeValue(r.Time)
+		}
+		// the time format may have spaces
+		if tm := string((*c.buf)[start:]); needsQuoting(tm) {
+			*c.buf = appendString((*c.buf)[:start], tm)
+			if c.stamp.end > 0 {
+				c.stamp.start, c.stamp.end = start, c.bufLen()
+			}
+		}
+		c.reserved = append(c.reserved, c.timeKey)
+	}
+
+	if len(c.levelKey) > 0 {
+		lvStr := c.levelText
+		if len(lvStr) == 0 {
+			lvStr = c.optionalStringLevel(r.Level, false)
+			if c.h.opts.StringLevel == nil && c.h.opts.StringLevelFunc == nil {
+				lvStr = strings.ToLower(lvStr)
+			}
+		}
+		c.addSpace(c.bufLen() > 0)
+		c.buf.writeString(c.levelKey)
+		c.buf.writeByte('=')
+		*c.buf = appendString(*c.buf, lvStr)
+		c.reserved = append(c.reserved, c.levelKey)
+	}
+
+	if len(c.msgKey) > 0 {
+		c.addSpace(c.bufLen() > 0)
+		c.buf.writeString(c.msgKey)
+		c.buf.writeByte('=')
+		*c.buf = appendString(*c.buf, r.Message)
+		c.reserved = append(c.reserved, c.msgKey)
+	}
+
+	// request id from the context
+	if rid := c.h.requestID(ctx); len(rid.Key) > 0 {
+		c.appendKeyValue(rid.Key, rid.Key, rid.Value.Resolve())
+		c.reserved = append(c.reserved, rid.Key)
+	}
+	c.appendSource(r.PC)
+	c.appendRecordAttrs(r, slog.Attr{})
+}
+
+// appendLogfmtValue writes v quoted if it has spaces, "=", quotes or
+// control characters, whatever the kind is
+func (c *composer) appendLogfmtValue(v slog.Value) {
+	var text string
+	switch v.Kind() {
+	case slog.KindTime:
+		text = v.Time().Format(c.h.opts.AttrTimeFormat)
+	case slog.KindAny:
+		text = v.String()
+		if c.h.opts.ExpandSlices {
+			if b, ok := appendSlice(v, nil, c.h.opts.AttrTimeFormat, nil); ok {
+				text = string(b)
+			}
+		}
+	default:
+		text = v.String()
+	}
+
+	*c.buf = appendString(*c.buf, text)
+}
@@ -1,7 +1,9 @@
 package slogconsole
 
 import (
+	"io"
 	"log/slog"
+	"strconv"
 	"sync/atomic"
 )
 
@@ -25,39 +27,603 @@ func (b *BoolVar) Set(v bool) {
 	b.val.Store(v)
 }
 
-const defaultTimeFormat = "2006-01-02 15:04:05.000"
+// constBool is the BoolValuer which can't be changed
+type constBool bool
+
+func (b constBool) Bool() bool {
+	return bool(b)
+}
+
+// ColorMode is an alternative to Options.Colorize in the --color=auto|always|never way
+type ColorMode int
+
+const (
+	// ColorAuto colorizes as Options.Colorize does by default
+	ColorAuto ColorMode = iota + 1
+	// ColorAlways colorizes
+	ColorAlways
+	// ColorNever doesn't colorize
+	ColorNever
+)
+
+// Format is the line format of the handler, see Options.Format
+type Format int
+
+const (
+	// FormatText writes the console line, e.g. "time LEVEL message key=value"
+	FormatText Format = iota
+	// FormatJSON writes the JSON object per line with time, level, msg and
+	// source keys and the attributes with the group prefix,
+	// e.g. {"time":"...","level":"INFO","msg":"message","grp.key":"value"}
+	FormatJSON
+	// FormatLogfmt writes the builtin fields as key=value as well,
+	// e.g. time=2023-09-10T20:00:00.000Z level=info msg="message" key=value
+	FormatLogfmt
+)
+
+// Palette holds the escape sequences used to colorize the "level" word
+type Palette struct {
+	// DEBUG and low
+	Debug string
+	// INFO
+	Info string
+	// WARN
+	Warn string
+	// ERROR and higher
+	Error string
+}
+
+// DefaultPalette returns the palette used if Options.Palette is not set
+func DefaultPalette() Palette {
+	return Palette{
+		Debug: ConsoleColorWhite,
+		Info:  ConsoleColorGreen,
+		Warn:  ConsoleColorYellow,
+		Error: ConsoleColorRed,
+	}
+}
+
+// Palette256 returns the palette of 256-color terminal codes, see Color256
+func Palette256() Palette {
+	return Palette{
+		Debug: Color256(245),
+		Info:  Color256(114),
+		Warn:  Color256(214),
+		Error: Color256(196),
+	}
+}
+
+// ColorScheme is the Palette name for Options.Colors
+type ColorScheme = Palette
+
+// PaletteValuer is the interface that wraps Palette method
+type PaletteValuer interface {
+	Palette() Palette
+}
+
+// PaletteVar represents atomic Palette value.
+// The zero PaletteVar holds DefaultPalette
+type PaletteVar struct {
+	val atomic.Pointer[Palette]
+}
+
+// Palette returns PaletteVar value
+func (p *PaletteVar) Palette() Palette {
+	if v := p.val.Load(); v != nil {
+		return *v
+	}
+
+	return DefaultPalette()
+}
+
+// Set sets PaletteVar with given value v
+func (p *PaletteVar) Set(v Palette) {
+	p.val.Store(&v)
+}
+
+// LevelIcons returns the emoji prefixes of the slog levels for
+// Options.LevelPrefix. Other levels have no icon, add them to the map if needed
+func LevelIcons() map[slog.Level]string {
+	return map[slog.Level]string{
+		slog.LevelDebug: "\U0001f41b ",
+		slog.LevelInfo:  "\u2139\ufe0f ",
+		slog.LevelWarn:  "\u26a0\ufe0f ",
+		slog.LevelError: "\u274c ",
+	}
+}
+
+// LevelFormat is a preset of the "level" word format
+type LevelFormat string
+
+const (
+	// LevelFormatName is the slog.Level string, e.g. INFO or ERROR+4
+	LevelFormatName LevelFormat = "name"
+	// LevelFormatNameNum is the name with the numeric level, e.g. INFO(0) or ERROR+4(12)
+	LevelFormatNameNum LevelFormat = "name(num)"
+	// LevelFormatChar is the first letter of the name, e.g. D, I, W or E.
+	// It is one column wide, so the messages are aligned
+	LevelFormatChar LevelFormat = "char"
+)
+
+// String returns the lv representation in the format
+func (f LevelFormat) String(lv slog.Level) string {
+	return f.format(lv.String(), lv)
+}
+
+// format returns the level name of lv in the format
+func (f LevelFormat) format(name string, lv slog.Level) string {
+	switch f {
+	case LevelFormatNameNum:
+		return name + "(" + strconv.Itoa(int(lv)) + ")"
+	case LevelFormatChar:
+		return name[:1]
+	default:
+		return name
+	}
+}
+
+// Levels commonly defined next to the slog ones, see Options.ExtendedLevels
+const (
+	LevelTrace slog.Level = -8
+	LevelFatal slog.Level = 12
+)
+
+// extendedLevelName returns the name of lv like slog.Level.String does with
+// LevelTrace and LevelFatal added, e.g. TRACE, TRACE+2 or FATAL
+func extendedLevelName(lv slog.Level) string {
+	str := func(base string, val slog.Level) string {
+		switch {
+		case val == 0:
+			return base
+		case val > 0:
+			return base + "+" + strconv.Itoa(int(val))
+		default:
+			return base + strconv.Itoa(int(val))
+		}
+	}
+
+	switch {
+	case lv < slog.LevelDebug:
+		return str("TRACE", lv-LevelTrace)
+	case lv >= LevelFatal:
+		return str("FATAL", lv-LevelFatal)
+	default:
+		return lv.String()
+	}
+}
+
+// KeyCollisionPolicy tells what to do with a record attribute having the key
+// of the attribute written by the handler, see Options.OnKeyCollision
+type KeyCollisionPolicy int
+
+const (
+	// KeyCollisionKeep writes both attributes
+	KeyCollisionKeep KeyCollisionPolicy = iota
+	// KeyCollisionSuffix writes the record attribute with the "_1" key suffix, e.g. "source_1"
+	KeyCollisionSuffix
+	// KeyCollisionSkip drops the record attribute
+	KeyCollisionSkip
+)
+
+// SortMode is the order of the attributes, see Options.SortAttrs
+type SortMode int
+
+const (
+	// SortNone keeps the order the attributes were added in
+	SortNone SortMode = iota
+	// SortKeys sorts the attributes by the full key, e.g. "a.b" goes after "a-c"
+	SortKeys
+	// SortGrouped sorts the top-level keys and groups, attributes of the
+	// group are kept together and sorted within the group
+	SortGrouped
+)
+
+const (
+	defaultTimeFormat = "2006-01-02 15:04:05.000"
+	// default time format of FormatLogfmt
+	logfmtTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+	subSecondFormat  = ".000"
+	multiLineIndent  = "  "
+	// separators of the fields and of the key and value
+	defaultFieldSeparator = " "
+	defaultKVSeparator    = "="
+	// key of the Options.RequestIDKey value
+	defaultRequestIDAttr = "request_id"
+	groupOverflow        = "…"
+	// width of the "level" word in the badge, DEBUG and ERROR fit
+	badgeWidth = 5
+	// bytes of the chain digest printed per line
+	checksumLen = 8
+	// size of the line chunk, see Options.Streaming
+	streamChunkSize = 4 << 10
+	// see KeyCollisionSuffix
+	keyCollisionSuffix = "_1"
+)
 
 // Options represents ConsoleHandler options
 type Options struct {
+	// Write the three-letter level names DBG, INF, WRN and ERR, e.g. ERROR+4
+	// is ERR+4, and TRC, FTL with ExtendedLevels. StringLevel and StringLevelFunc
+	// take precedence
+	AbbreviatedLevels bool
+
 	// AddSource causes the handler to compute the source code position
 	// of the log statement and add a SourceKey attribute to the output.
 	AddSource bool
 
+	// Pad the attribute keys of the record with spaces to the longest one
+	// before the "=", e.g. "a  =1 bcd=2". Not used by AttrsAsJSON
+	AlignAttrs bool
+
+	// Size of the AsyncWrite queue.
+	// Default: 1024
+	AsyncQueueSize int
+
+	// Write lines in a separate goroutine through the bounded queue,
+	// so loggers don't wait for each other on the writer.
+	// ConsoleHandler.Close must be called to flush the queue
+	AsyncWrite bool
+
+	// Format of the time attributes, e.g. time.RFC3339 while the record
+	// time is in the compact TimeFormat. Time elements of ExpandSlices too.
+	// Default: TimeFormat
+	AttrTimeFormat string
+
+	// Render attributes as a single JSON object after the message,
+	// groups become nested objects. Time, level and message stay as is
+	AttrsAsJSON bool
+
+	// Wrap the attributes to the continuation lines at the terminal width of
+	// the writer, 80 if it can't be detected. Writers may report the width
+	// with the Width() int method
+	AutoWidth bool
+
+	// Write the "level" word in bold if Colorize is on. Not used with
+	// LevelBadge and ColorizeLine
+	BoldLevel bool
+
 	// Colorize the "level" word
 	// DEBUG and low - white
 	// INFO - green
 	// WARN - yellow
 	// ERRPR and higher - red
 	// Can be change cuncurently
+	// Default: on if NO_COLOR is not set and either FORCE_COLOR is set or
+	// the writer is a terminal, see ConsoleHandler.SetOutput
 	Colorize BoolValuer
 
-	// Remove time part from message line
+	// Colorize true values green, false and nil gray if Colorize is on
+	ColorBooleans bool
+
+	// Fixed colors of the "level" word, used if Palette is not set.
+	// Default: DefaultPalette
+	Colors *ColorScheme
+
+	// Takes precedence over Colorize if set
+	ColorMode ColorMode
+
+	// Colorize the whole line with the level color instead of the "level"
+	// word only. The color is reset right before the new line
+	ColorizeLine bool
+
+	// Start of the continuation lines of MultiLine and GroupBlocks,
+	// e.g. "  | ". Group block lines are indented after it. The empty
+	// string writes the lines without the indentation.
+	// Default: two spaces
+	ContinuationPrefix *string
+
+	// Sequence closing the colorized text.
+	// Default: ConsoleColorReset
+	ColorReset string
+
+	// Write only the last of the attributes with the same key, the group
+	// prefix is the part of the key, e.g. With("k", 1).Info("msg", "k", 2)
+	// writes k=2. Not used by AttrsAsJSON
+	DedupKeys bool
+
+	// Duration and time attributes with these keys also render the
+	// difference with the value of the previous record after FieldSeparator,
+	// e.g. "elapsed=1.2s (+300ms)".
+	// Key is matched with the group prefix, e.g. "grp.elapsed"
+	DeltaKeys []string
+
+	// Remove the level from message line, Enabled still filters by Level.
+	// ReplaceAttr isn't called for the level then
+	DropLevel bool
+
+	// Remove time part from message line. Zero record time is always
+	// omitted, whatever the option is
 	DropTime bool
 
+	// Write the time since the handler creation instead of the record time,
+	// e.g. "+1.234s". TimeFormat, SubSecondOnly and UTC are not used then
+	ElapsedTime bool
+
+	// Escape "." and "\" inside of group names with "\", so the group
+	// "a.b" is printed as "a\.b.key" and differs from nested "a" and "b"
+	EscapeKeySeparator bool
+
+	// Write newlines and carriage returns of the message as "\n" and "\r",
+	// so the record stays on one line. Can be changed concurrently.
+	// Not used by FormatJSON and FormatLogfmt, they quote the message.
+	// Default: on
+	EscapeMessageNewlines BoolValuer
+
+	// Write newlines of string values as "\n" and "\r" without quoting
+	// the whole value, e.g. "out=line1\nline2" instead of "out="line1\nline2"".
+	// Values are quoted as usual if they have other characters that need it
+	EscapeNewlinesInValues bool
+
+	// Exit code of the process, see ExitLevel
+	ExitCode int
+
+	// Call os.Exit with ExitCode after the record of the level or higher is
+	// written, e.g. LevelFatal. The AsyncWrite queue is written before
+	// the record. Nil is never exit
+	ExitLevel *slog.Level
+
+	// Name LevelTrace and LevelFatal levels TRACE and FATAL instead of DEBUG-4
+	// and ERROR+4. TRACE is colorized like DEBUG and FATAL like ERROR
+	ExtendedLevels bool
+
+	// Render slices and arrays as [a,b,c] instead of the fmt [a b c].
+	// String elements are quoted like the string values, by QuoteAllStrings
+	// and NeedsQuoting
+	ExpandSlices bool
+
+	// Separator of the line fields, e.g. "\t". The values are quoted by
+	// the usual rules, so the separator should be a space or a character
+	// that is quoted anyway. Not used by FormatJSON and FormatLogfmt.
+	// Default: " "
+	FieldSeparator string
+
+	// Line format. FormatJSON doesn't use colors and the layout options of
+	// the text, e.g. AttrsAsJSON, MultiLine, HashChain or TimeFormat, but
+	// DedupKeys and SortAttrs are applied.
+	// FormatLogfmt doesn't use colors and the multi-line layouts, its
+	// TimeFormat is RFC 3339 with milliseconds by default.
+	// Default: FormatText
+	Format Format
+
+	// Write attributes of each top-level group in the indented block under
+	// the group name line instead of the dotted prefix. Other attributes
+	// stay on the first line
+	GroupBlocks bool
+
+	// Append chk=<digest> to every line. The digest is computed over the
+	// line and the digest of the previous line, so removing or changing
+	// any line breaks the chain
+	HashChain bool
+
+	// Add pid=<process id> attribute to every line
+	IncludePID bool
+
+	// IncludeAttr is called for each non-group attribute, the attribute is
+	// skipped if it returns false. The groups include the group attributes
+	// the attribute belongs to. It is called after ReplaceAttr
+	IncludeAttr func(groups []string, a slog.Attr) bool
+
+	// Color of the attribute keys if Colorize is on, e.g. ConsoleColorCyan.
+	// Empty is not colorized. Not used by AttrsAsJSON
+	KeyColor string
+
+	// KeyTransform is called to rewrite each attribute key before it is
+	// merged with the group prefix, e.g. to normalize snake_case to camelCase
+	KeyTransform func(string) string
+
+	// Separator of the key and value, e.g. ":". Not used by FormatJSON
+	// and FormatLogfmt.
+	// Default: "="
+	KVSeparator string
+
+	// Write the "level" word as a badge: padded to the same width and on the
+	// background color if Colorize is on, e.g. " INFO  " or " ERROR "
+	LevelBadge bool
+
+	// Preset of the "level" word, used if neither StringLevel nor StringLevelFunc set.
+	// Default: LevelFormatName
+	LevelFormat LevelFormat
+
+	// Plain text written before the "level" word of the exact level,
+	// e.g. ">>> " for slog.LevelError or the icons of LevelIcons.
+	// It is not colorized
+	LevelPrefix map[slog.Level]string
+
+	// Pad the "level" word with trailing spaces to the given number of
+	// columns, so the messages are aligned. Not used with LevelBadge
+	LevelWidth int
+
 	// Level reports the minimum record level that will be logged.
 	Level slog.Leveler
 
-	// ReplaceAttr is called to rewrite each non-group attribute before it is logged.
+	// Collapse group prefix longer than the given number of segments,
+	// e.g. "a.b.c.d.e.key" with 3 is printed as "a.b…e.key". Zero is no limit
+	MaxGroupPrefixSegments int
+
+	// Call OnRotate once the bytes written since the start, the last
+	// OnRotate or SetOutput reach the limit. The handler doesn't rotate
+	// anything itself. Zero is no limit
+	MaxTotalBytes int64
+
+	// Collapse consecutive WithGroup calls with the same name, so
+	// WithGroup("a").WithGroup("a") is "a" instead of "a.a"
+	MergeDuplicateGroups bool
+
+	// Replace "{key}" placeholders of the message with the values of the
+	// record attributes, e.g. "user {user} logged in" with "user", "bob" is
+	// "user bob logged in". Matched attributes are not written again,
+	// placeholders without the attribute are kept as is
+	MessageTemplate bool
+
+	// Print time, level and message on the first line and then each
+	// attribute on its own line indented with ContinuationPrefix.
+	// The "=" are aligned, KeyColor and ValueColor are kept
+	MultiLine bool
+
+	// Reports whether the string attribute value is quoted, e.g. to quote
+	// the values with commas or to never quote. The default quotes empty
+	// strings and the ones with spaces, "=", quotes or control characters.
+	// QuoteAllStrings takes precedence. Not used by AttrsAsJSON and FormatJSON
+	NeedsQuoting func(string) bool
+
+	// OnUnknownKind is called for the value of the slog.Kind unknown to the
+	// handler, e.g. added by a newer Go version. The value is written with fmt
+	OnUnknownKind func(v slog.Value)
+
+	// OnRotate is called after the write exceeding MaxTotalBytes, the
+	// counter is reset. It may swap the writer with SetOutput
+	OnRotate func()
+
+	// What to do if the attribute has the key of the field written by the
+	// handler: "source" of AddSource, RequestIDAttr and the time, level and
+	// message keys of FormatJSON and FormatLogfmt. Attributes of WithAttrs
+	// are checked against the default keys, RequestIDAttr isn't known then.
+	// Attributes of AttrsAsJSON are not checked.
+	// Default: KeyCollisionKeep
+	OnKeyCollision KeyCollisionPolicy
+
+	// What to do if the AsyncWrite queue is full.
+	// Default: QueueFullBlock
+	OnQueueFull QueueFullPolicy
+
+	// Colors of the "level" word if Colorize is on.
+	// Can be change cuncurently
+	// Default: DefaultPalette
+	Palette PaletteValuer
+
+	// Quote every string attribute value, e.g. s="hello", not only the ones
+	// with spaces or special characters. Keys, the message and the values
+	// of MessageTemplate are not quoted. Not used by AttrsAsJSON and FormatJSON
+	QuoteAllStrings bool
+
+	// ReplaceAttr is called to rewrite each attribute before it is logged.
 	// The attribute's value has been resolved (see [Value.Resolve]).
 	// If ReplaceAttr returns a zero Attr, the attribute is discarded.
+	// The groups are of WithGroup and the group attributes containing
+	// the attribute. Group attributes are passed too, so they may be renamed
+	// or dropped as a whole
+	//
+	// The built-in time, level and message are passed with slog.TimeKey,
+	// slog.LevelKey and slog.MessageKey and nil groups. The returned empty key
+	// drops the field, the other key is written by FormatJSON and FormatLogfmt
+	// only. The source of AddSource is passed with slog.SourceKey and nil
+	// groups under WithGroup too. The replaced level is used for the color and the writer as well.
+	// The source is passed with slog.SourceKey
 	ReplaceAttr func(groups []string, a slog.Attr) slog.Attr
 
+	// Context key of the request id. If the context of the record has the
+	// value, it is written as the first attribute out of groups
+	RequestIDKey any
+
+	// Attribute key of the RequestIDKey value.
+	// Default: request_id
+	RequestIDAttr string
+
+	// Skip records logged with a done context, Handle returns ctx.Err()
+	RespectContextCancel bool
+
+	// Write the attributes to the output in chunks as the line grows instead
+	// of building the whole line first. It lowers the peak memory of huge
+	// records, but the line is not written with a single Write call anymore:
+	// the lock is held for the whole record, so lines of the handler
+	// don't interleave, but other writers of the output may break into the line
+	// and a failed write leaves the partial line.
+	// Ignored with AlignAttrs, AsyncWrite, AttrsAsJSON, DedupKeys, GroupBlocks,
+	// HashChain, MultiLine, SortAttrs and Template
+	Streaming bool
+
 	// Change the "level" word. May be used in case of the extended list of levels
 	StringLevel func(slog.Level) string
 
+	// Same as StringLevel, but also receives whether the "level" word is colorized.
+	// Takes precedence over StringLevel
+	StringLevelFunc func(lv slog.Level, colored bool) string
+
+	// Order of the attributes, both of WithAttrs and the record ones.
+	// Not applied if AttrsAsJSON is on.
+	// Default: SortNone
+	SortAttrs SortMode
+
+	// Cache up to the number of formatted sources by the program counter, so
+	// logging from the same line again skips the frame lookup. Zero is no cache
+	SourceCacheSize int
+
+	// Write the function name before the source file, the value is quoted
+	// then, e.g. source="pkg.(*Type).Method (file.go:42)".
+	// Applied if AddSource is on
+	SourceFunction bool
+
+	// Remove the prefix from the source file path, e.g. "/home/me/proj" makes
+	// "/home/me/proj/pkg/x.go" "pkg/x.go". Paths without the prefix are written in full
+	SourceTrimPrefix string
+
+	// Write the base name of the source file only, e.g. "source=handler.go:83".
+	// Applied if AddSource is on
+	ShortSource bool
+
+	// Sort the attributes of each WithAttrs call by the key, the record
+	// attributes keep their order. Groups are sorted by the name and their
+	// attributes keep the order
+	SortPreformatted bool
+
+	// Write the group path of WithGroup after the message, e.g. "[grp1.grp2]",
+	// even if there are no attributes
+	ShowActiveGroup bool
+
+	// Print the full timestamp only once per second. Following records
+	// within the same second get the sub-second offset only, e.g. ".123".
+	// The seconds are compared in the write order
+	SubSecondOnly bool
+
+	// Color of the record time if Colorize is on and ColorizeLine is off.
+	// ConsoleColorDefault keeps the terminal color.
+	// Default: ConsoleColorDarkGray
+	TimeColor string
+
 	// Custom timestamp format.
 	// Default: 2006-01-02 15:04:05.000"
 	TimeFormat string
+
+	// Move time to the end of the line after attributes
+	TimeLast bool
+
+	// Layout of the line with the {time}, {level}, {msg}, {source} and
+	// {attrs} placeholders and the text between them, e.g. "{level} {time} {msg} {attrs}".
+	// The text after the empty placeholder is dropped. TimeLast and ShowActiveGroup
+	// are not used then. The invalid template is ignored, so check it with
+	// ValidateTemplate up front.
+	// Default: time, level, message, source and attributes separated with spaces
+	Template string
+
+	// End each line with the field separator, so every field of the
+	// line is followed by it. Helps grep and awk
+	TrailingSeparator bool
+
+	// Convert the record time to UTC before formatting it
+	UTC bool
+
+	// Write the record time as seconds since epoch with milliseconds,
+	// e.g. "1694376000.123". TimeFormat, SubSecondOnly and UTC are not used then
+	UnixTime bool
+
+	// Unit written after the value of the attribute with the key, e.g.
+	// {"latency": "ms"} prints latency=23ms. Key is matched with the group
+	// prefix, e.g. "grp.latency". Not used by AttrsAsJSON
+	UnitKeys map[string]string
+
+	// Color of the attribute values if Colorize is on, the unit is colored
+	// too. Empty is not colorized. Not used by AttrsAsJSON
+	ValueColor string
+
+	// Write UTF-8 byte order mark before the first line to the writer.
+	// Some Windows tools expect it at the start of a file
+	WriteBOM bool
+
+	// WriterFor returns the writer of the records of the level, e.g. os.Stderr
+	// for WARN and higher. Nil falls back to the handler writer. Writes to all
+	// the writers go under the handler mutex. Colors are detected for the
+	// handler writer only
+	WriterFor func(slog.Level) io.Writer
 }
 
 func optionalLevelVar(lv slog.Leveler) slog.Leveler {
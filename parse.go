@@ -0,0 +1,297 @@
+package slogconsole
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLine parses a line written by ConsoleHandler back into a record.
+// The opts must be the same as the handler ones, if nil the defaults are used.
+//
+// The output is not fully reversible, so the following limits apply:
+//   - The level must be in the Options.LevelFormat form of the slog.Level
+//     text, e.g. INFO, ERROR+4(12) or E. Options.StringLevel is not reversed,
+//     LevelFormatChar is restored as the base level, e.g. ERROR for ERROR+4.
+//     The level is zero if Options.DropLevel is set
+//   - The message ends at the first key=value token
+//   - Unquoted values are restored as int, uint, float, bool or duration if
+//     they are printed back the same way, otherwise as string
+//   - Dotted keys become groups
+//   - Options.SubSecondOnly timestamps can't be parsed
+func ParseLine(s string, opts *Options) (r slog.Record, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	layout := opts.TimeFormat
+	if len(layout) == 0 {
+		layout = defaultTimeFormat
+	}
+	p := parser{sep: opts.FieldSeparator, kv: opts.KVSeparator}
+	if len(p.sep) == 0 {
+		p.sep = defaultFieldSeparator
+	}
+	if len(p.kv) == 0 {
+		p.kv = defaultKVSeparator
+	}
+
+	s = stripANSI(strings.TrimRight(s, "\n"))
+	if opts.MultiLine {
+		prefix := multiLineIndent
+		if opts.ContinuationPrefix != nil {
+			prefix = *opts.ContinuationPrefix
+		}
+		s = p.joinMultiLine(s, prefix)
+	}
+
+	tokens, err := p.splitTokens(s)
+	if err != nil {
+		return
+	}
+
+	var tm time.Time
+	if !opts.DropTime {
+		n := strings.Count(layout, p.sep) + 1
+		if len(tokens) < n {
+			return r, errors.New("missing time")
+		}
+
+		var tmStr string
+		if opts.TimeLast {
+			tmStr = strings.Join(tokens[len(tokens)-n:], p.sep)
+			tokens = tokens[:len(tokens)-n]
+		} else {
+			tmStr = strings.Join(tokens[:n], p.sep)
+			tokens = tokens[n:]
+		}
+
+		if tm, err = time.Parse(layout, tmStr); err != nil {
+			return
+		}
+	}
+
+	var lv slog.Level
+	if !opts.DropLevel {
+		if len(tokens) == 0 {
+			return r, errors.New("missing level")
+		}
+		if lv, err = parseLevel(tokens[0], opts.LevelFormat); err != nil {
+			return
+		}
+		tokens = tokens[1:]
+	}
+
+	// message is everything before the first attribute
+	n := 0
+	for n < len(tokens) && !p.isAttrToken(tokens[n]) {
+		n++
+	}
+	msg := strings.Join(tokens[:n], p.sep)
+
+	kvs, err := p.parseAttrTokens(tokens[n:])
+	if err != nil {
+		return
+	}
+	if opts.HashChain && len(kvs) > 0 && kvs[len(kvs)-1].path[0] == "chk" {
+		kvs = kvs[:len(kvs)-1]
+	}
+
+	r = slog.NewRecord(tm, lv, msg, 0)
+	r.AddAttrs(buildAttrs(kvs)...)
+
+	return
+}
+
+// parser splits the line by Options.FieldSeparator and Options.KVSeparator
+type parser struct {
+	sep, kv string
+}
+
+// parseLevel reverses LevelFormat.String
+func parseLevel(s string, f LevelFormat) (lv slog.Level, err error) {
+	switch f {
+	case LevelFormatNameNum:
+		i := strings.LastIndexByte(s, '(')
+		if i < 0 || !strings.HasSuffix(s, ")") {
+			return lv, fmt.Errorf("level %q: missing number", s)
+		}
+		n, err := strconv.Atoi(s[i+1 : len(s)-1])
+		if err != nil {
+			return lv, fmt.Errorf("level %q: %w", s, err)
+		}
+		return slog.Level(n), nil
+	case LevelFormatChar:
+		for _, v := range [...]slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError} {
+			if s == v.String()[:1] {
+				return v, nil
+			}
+		}
+		return lv, fmt.Errorf("level %q: unknown", s)
+	}
+
+	err = lv.UnmarshalText([]byte(s))
+	return
+}
+
+// pathValue is a parsed attribute with the key split by group
+type pathValue struct {
+	path []string
+	val  slog.Value
+}
+
+func (p parser) parseAttrTokens(tokens []string) (kvs []pathValue, err error) {
+	for i := 0; i < len(tokens); {
+		key, val, _ := strings.Cut(tokens[i], p.kv)
+		i++
+
+		var v slog.Value
+		if strings.HasPrefix(val, `"`) {
+			if val, err = strconv.Unquote(val); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			v = slog.StringValue(val)
+		} else {
+			// unquoted values with spaces, e.g. time or error
+			for ; i < len(tokens) && !p.isAttrToken(tokens[i]); i++ {
+				val += p.sep + tokens[i]
+			}
+			v = inferValue(val)
+		}
+
+		kvs = append(kvs, pathValue{path: strings.Split(key, "."), val: v})
+	}
+
+	return
+}
+
+func buildAttrs(kvs []pathValue) (attrs []slog.Attr) {
+	for i := 0; i < len(kvs); {
+		if len(kvs[i].path) == 1 {
+			attrs = append(attrs, slog.Attr{Key: kvs[i].path[0], Value: kvs[i].val})
+			i++
+			continue
+		}
+
+		// consecutive keys of the same group
+		g := kvs[i].path[0]
+		j := i
+		for j < len(kvs) && len(kvs[j].path) > 1 && kvs[j].path[0] == g {
+			j++
+		}
+
+		sub := make([]pathValue, 0, j-i)
+		for _, kv := range kvs[i:j] {
+			sub = append(sub, pathValue{path: kv.path[1:], val: kv.val})
+		}
+		attrs = append(attrs, slog.Attr{Key: g, Value: slog.GroupValue(buildAttrs(sub)...)})
+
+		i = j
+	}
+
+	return
+}
+
+// inferValue restores the value kind if the value is printed back the same way
+func inferValue(s string) slog.Value {
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(v, 10) == s {
+		return slog.Int64Value(v)
+	}
+	if v, err := strconv.ParseUint(s, 10, 64); err == nil && strconv.FormatUint(v, 10) == s {
+		return slog.Uint64Value(v)
+	}
+	if v, err := strconv.ParseFloat(s, 64); err == nil && strconv.FormatFloat(v, 'g', -1, 64) == s {
+		return slog.Float64Value(v)
+	}
+	if s == "true" || s == "false" {
+		return slog.BoolValue(s == "true")
+	}
+	if v, err := time.ParseDuration(s); err == nil && v.String() == s {
+		return slog.DurationValue(v)
+	}
+
+	return slog.StringValue(s)
+}
+
+// isAttrToken reports whether the token looks like key=value
+func (p parser) isAttrToken(t string) bool {
+	i := strings.Index(t, p.kv)
+	return i > 0 && strings.IndexByte(t[:i], '"') < 0
+}
+
+// splitTokens splits s by the field separator, separators inside of quoted
+// values are kept
+func (p parser) splitTokens(s string) (tokens []string, err error) {
+	for i := 0; i < len(s); {
+		if strings.HasPrefix(s[i:], p.sep) {
+			i += len(p.sep)
+			continue
+		}
+
+		start := i
+		for i < len(s) && !strings.HasPrefix(s[i:], p.sep) {
+			if s[i] == '"' && i > start && strings.HasSuffix(s[start:i], p.kv) {
+				if i, err = skipQuoted(s, i); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			i++
+		}
+		tokens = append(tokens, s[start:i])
+	}
+
+	return
+}
+
+// skipQuoted returns the position after the closing quote
+func skipQuoted(s string, i int) (int, error) {
+	for i++; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		}
+	}
+
+	return i, errors.New("unterminated quoted string")
+}
+
+// joinMultiLine converts Options.MultiLine output to a single line
+func (p parser) joinMultiLine(s, prefix string) string {
+	lines := strings.Split(s, "\n")
+	for i := 1; i < len(lines); i++ {
+		line := strings.TrimPrefix(lines[i], prefix)
+		if k, v, ok := strings.Cut(line, p.kv); ok {
+			line = strings.TrimRight(k, " ") + p.kv + v
+		}
+		lines[i] = line
+	}
+
+	return strings.Join(lines, p.sep)
+}
+
+// stripANSI removes color escape sequences
+func stripANSI(s string) string {
+	if strings.IndexByte(s, '\033') < 0 {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\033' && i+1 < len(s) && s[i+1] == '[' {
+			j := i + 2
+			for j < len(s) && (s[j] < '@' || s[j] > '~') {
+				j++
+			}
+			i = j
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
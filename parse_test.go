@@ -0,0 +1,151 @@
+package slogconsole
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, test := range []struct {
+		name string
+		opts *Options
+		call func(*slog.Logger)
+	}{
+		{
+			name: "msg",
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage)
+			},
+		},
+		{
+			name: "msg+attrs",
+			call: func(lg *slog.Logger) {
+				lg.Warn(testMessage,
+					slog.String("string", testString),
+					slog.Int("status", testInt),
+					slog.Duration("duration", testDuration),
+					slog.Float64("ratio", 0.25),
+					slog.Bool("ok", true),
+					slog.String("quoted", "quote me \"please\""),
+					slog.String("number", "007"),
+				)
+			},
+		},
+		{
+			name: "grp+attrs",
+			call: func(lg *slog.Logger) {
+				lg.WithGroup("grp").With("strkey", testString).
+					WithGroup("grp2").Log(context.Background(), slog.LevelError+4, testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "color+droptime",
+			opts: &Options{Colorize: newBoolBar(true), DropTime: true},
+			call: func(lg *slog.Logger) {
+				lg.Debug(testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "timelast+format",
+			opts: &Options{TimeLast: true, TimeFormat: time.RFC3339Nano},
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "separators",
+			opts: &Options{FieldSeparator: "\t", KVSeparator: ":"},
+			call: func(lg *slog.Logger) {
+				lg.WithGroup("grp").Info(testMessage,
+					slog.String("string", testString),
+					slog.Int("status", testInt),
+					slog.Duration("duration", testDuration),
+				)
+			},
+		},
+		{
+			name: "separators+multiline",
+			opts: &Options{FieldSeparator: " | ", KVSeparator: ": ", MultiLine: true},
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage, "key", testInt, slog.Group("grp", "longer_key", testString))
+			},
+		},
+		{
+			name: "droplevel",
+			opts: &Options{DropLevel: true},
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "levelformat=name(num)",
+			opts: &Options{LevelFormat: LevelFormatNameNum},
+			call: func(lg *slog.Logger) {
+				lg.Log(context.Background(), slog.LevelError+4, testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "levelformat=char",
+			opts: &Options{LevelFormat: LevelFormatChar},
+			call: func(lg *slog.Logger) {
+				lg.Warn(testMessage, "key", testInt)
+			},
+		},
+		{
+			name: "multiline",
+			opts: &Options{MultiLine: true},
+			call: func(lg *slog.Logger) {
+				lg.Info(testMessage, "key", testInt, slog.Group("grp", "longer_key", testString))
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := test.opts
+			if opts == nil {
+				opts = &Options{}
+			}
+			opts.Level = slog.LevelDebug
+			hd := New(buf, opts)
+
+			test.call(slog.New(hd))
+			line := buf.String()
+			buf.Reset()
+
+			r, err := ParseLine(line, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Message != testMessage {
+				t.Errorf("got message %q, want %q", r.Message, testMessage)
+			}
+
+			if err = hd.Handle(context.Background(), r); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != line {
+				t.Errorf("\ngot  %q\nwant %q", got, line)
+			}
+
+			buf.Reset()
+		})
+	}
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"2023-09-10",
+		"2023-09-10 20:00:00.000",
+		"2023-09-10 20:00:00.000 NOTICE " + testMessage,
+		`2023-09-10 20:00:00.000 INFO ` + testMessage + ` key="unterminated`,
+	} {
+		if _, err := ParseLine(line, nil); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
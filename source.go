@@ -0,0 +1,51 @@
+package slogconsole
+
+import "sync"
+
+// sourceCache maps program counters to the formatted sources,
+// see Options.SourceCacheSize
+type sourceCache struct {
+	mu    sync.RWMutex
+	size  int
+	items map[uintptr]string
+}
+
+func newSourceCache(size int) *sourceCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &sourceCache{
+		size:  size,
+		items: make(map[uintptr]string, size),
+	}
+}
+
+// get returns the cached source of pc, nil cache has nothing
+func (sc *sourceCache) get(pc uintptr) (string, bool) {
+	if sc == nil {
+		return "", false
+	}
+
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	src, ok := sc.items[pc]
+	return src, ok
+}
+
+// put caches the source of pc. The full cache is emptied first, hot call
+// sites fill it again quickly
+func (sc *sourceCache) put(pc uintptr, src string) {
+	if sc == nil {
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if len(sc.items) >= sc.size {
+		clear(sc.items)
+	}
+	sc.items[pc] = src
+}
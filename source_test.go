@@ -0,0 +1,60 @@
+package slogconsole
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+func TestSourceCache(t *testing.T) {
+	sc := newSourceCache(2)
+	for pc := uintptr(1); pc <= 5; pc++ {
+		sc.put(pc, "src")
+		if n := len(sc.items); n > 2 {
+			t.Fatalf("got %d items, want at most 2", n)
+		}
+	}
+	if src, ok := sc.get(5); !ok || src != "src" {
+		t.Errorf("got %q %t, want the last put", src, ok)
+	}
+
+	if newSourceCache(0) != nil {
+		t.Error("got cache of zero size")
+	}
+}
+
+func TestConsoleTextHandlerSourceCache(t *testing.T) {
+	want := bytes.NewBuffer(make([]byte, 0, 1024))
+	got := bytes.NewBuffer(make([]byte, 0, 1024))
+
+	for _, w := range []*bytes.Buffer{want, got} {
+		opts := &Options{
+			AddSource:   true,
+			Colorize:    newBoolBar(false),
+			DropTime:    true,
+			ShortSource: true,
+		}
+		if w == got {
+			opts.SourceCacheSize = 4
+		}
+		logger := slog.New(New(w, opts))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					logger.Info(testMessage)
+				}
+			}()
+		}
+		wg.Wait()
+		logger.Info(testMessage)
+	}
+
+	if got.String() != want.String() {
+		t.Errorf("cached sources differ:\ngot  %q\nwant %q", got.String(), want.String())
+	}
+}
@@ -0,0 +1,38 @@
+package slogconsole
+
+import (
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+)
+
+// StartupAttrs returns the attributes describing the running binary: the Go
+// version, the platform and the main module build info if available, e.g.
+//
+//	go=go1.21.5 platform=linux/amd64 build.path=example.com/app build.version=v1.2.0
+//
+// It is intended to be attached once at init with Logger.With or WithAttrs
+func StartupAttrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("go", runtime.Version()),
+		slog.String("platform", runtime.GOOS+"/"+runtime.GOARCH),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return attrs
+	}
+
+	build := []any{
+		slog.String("path", bi.Main.Path),
+		slog.String("version", bi.Main.Version),
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			build = append(build, slog.String(s.Key[len("vcs."):], s.Value))
+		}
+	}
+
+	return append(attrs, slog.Group("build", build...))
+}
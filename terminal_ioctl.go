@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package slogconsole
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fileTerminal reports whether f is a terminal and returns its number of
+// columns. Unlike os.ModeCharDevice, /dev/null is not a terminal
+func fileTerminal(f *os.File) (int, bool) {
+	var ws struct {
+		row, col, xpixel, ypixel uint16
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, false
+	}
+
+	return int(ws.col), true
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package slogconsole
+
+import "os"
+
+// fileTerminal reports whether f is a character device, e.g. terminal.
+// The width is not detected on the platform
+func fileTerminal(f *os.File) (int, bool) {
+	fi, err := f.Stat()
+	return 0, err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
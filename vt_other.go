@@ -0,0 +1,10 @@
+//go:build !windows
+
+package slogconsole
+
+import "io"
+
+// enableVT reports true, terminals process the ANSI escape sequences natively
+func enableVT(io.Writer) bool {
+	return true
+}
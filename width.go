@@ -0,0 +1,94 @@
+package slogconsole
+
+import (
+	"io"
+	"os"
+	"unicode"
+	"unicode/utf8"
+)
+
+// VisibleLen returns the number of terminal columns taken by b. Color escape
+// sequences take none, East Asian wide runes take two, combining marks and
+// control characters take none
+func VisibleLen(b []byte) (n int) {
+	for i := 0; i < len(b); {
+		if b[i] == '\033' && i+1 < len(b) && b[i+1] == '[' {
+			i += 2
+			for i < len(b) && (b[i] < '@' || b[i] > '~') {
+				i++
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRune(b[i:])
+		n += runeWidth(r)
+		i += size
+	}
+
+	return
+}
+
+func visibleLen(s string) int {
+	return VisibleLen([]byte(s))
+}
+
+// defaultWidth is the terminal width if it can't be detected, see Options.AutoWidth
+const defaultWidth = 80
+
+// terminalWidth returns the number of columns of the terminal w or
+// defaultWidth. Writers may implement Width() int to report it on their own
+func terminalWidth(w io.Writer) int {
+	n := 0
+	switch v := w.(type) {
+	case interface{ Width() int }:
+		n = v.Width()
+	case *os.File:
+		n, _ = fileTerminal(v)
+	}
+
+	if n <= 0 {
+		return defaultWidth
+	}
+	return n
+}
+
+// wideRanges are the East Asian wide and fullwidth runes and emoji
+var wideRanges = []struct{ lo, hi rune }{
+	{0x1100, 0x115F},
+	{0x2E80, 0x303E},
+	{0x3041, 0x33FF},
+	{0x3400, 0x4DBF},
+	{0x4E00, 0x9FFF},
+	{0xA000, 0xA4CF},
+	{0xAC00, 0xD7A3},
+	{0xF900, 0xFAFF},
+	{0xFE30, 0xFE4F},
+	{0xFF00, 0xFF60},
+	{0xFFE0, 0xFFE6},
+	{0x1F300, 0x1F64F},
+	{0x1F900, 0x1F9FF},
+	{0x20000, 0x3FFFD},
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r < ' ' || r == 0x7f:
+		return 0
+	case r < utf8.RuneSelf:
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf, unicode.Cc):
+		return 0
+	}
+
+	for _, wr := range wideRanges {
+		if r < wr.lo {
+			break
+		}
+		if r <= wr.hi {
+			return 2
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,28 @@
+package slogconsole
+
+import "testing"
+
+func TestVisibleLen(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"INFO", 4},
+		{ConsoleColorGreen + "INFO" + ConsoleColorReset, 4},
+		{Color256(114) + "INFO" + "\033[39;49;22m", 4},
+		{ConsoleBgRed + " ERROR " + ConsoleColorReset, 7},
+		{"привет", 6},
+		{"日本語", 6},
+		{ConsoleColorRed + "日本" + ConsoleColorReset + "x", 5},
+		{"ｆｕｌｌ", 8},
+		{"é", 1},
+		{"🔥", 2},
+		{"a\tb", 2},
+		{"\033[31", 0},
+	} {
+		if got := VisibleLen([]byte(tt.s)); got != tt.want {
+			t.Errorf("VisibleLen(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package slogconsole
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// detectColor reports whether colors are supported by w. NO_COLOR environment
+// variable turns colors off, see https://no-color.org. Otherwise FORCE_COLOR
+// turns them on, see https://force-color.org. Otherwise w must be a terminal
+func detectColor(w io.Writer) bool {
+	if len(os.Getenv("NO_COLOR")) > 0 {
+		return false
+	}
+
+	return forceColor() || isTerminal(w)
+}
+
+// forceColor reports whether FORCE_COLOR environment variable is set and
+// not "0" or "false"
+func forceColor() bool {
+	switch os.Getenv("FORCE_COLOR") {
+	case "", "0", "false":
+		return false
+	default:
+		return true
+	}
+}
+
+// isTerminal reports whether w is a terminal.
+// Writers may implement IsTerminal() bool to report it on their own
+func isTerminal(w io.Writer) bool {
+	switch v := w.(type) {
+	case interface{ IsTerminal() bool }:
+		return v.IsTerminal()
+	case *os.File:
+		_, ok := fileTerminal(v)
+		return ok
+	default:
+		return false
+	}
+}
+
+// vtState enables the escape sequences processing of the writers the first
+// time the colors are written, so the console mode isn't changed if they
+// never are, see enableVT
+type vtState struct {
+	mu sync.Mutex
+	// writers to enable, nil once enabled
+	ws   []io.Writer
+	done atomic.Bool
+	on   atomic.Bool
+}
+
+// enabled reports whether all the writers process the escape sequences
+func (v *vtState) enabled() bool {
+	if v.done.Load() {
+		return v.on.Load()
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.done.Load() {
+		on := true
+		for _, w := range v.ws {
+			on = consoleVT(w) && on
+		}
+		v.ws = nil
+		v.on.Store(on)
+		v.done.Store(true)
+	}
+
+	return v.on.Load()
+}
+
+// reset sets the writers to enable on the next colored record
+func (v *vtState) reset(ws ...io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.ws = ws
+	v.done.Store(false)
+}
+
+// utf8BOM is the UTF-8 byte order mark
+const utf8BOM = "\xef\xbb\xbf"
+
+// bomWriter writes UTF-8 BOM before the first write.
+// Handler calls Write under the mutex, so no extra locking
+type bomWriter struct {
+	w    io.Writer
+	done bool
+}
+
+func (b *bomWriter) Write(p []byte) (int, error) {
+	if !b.done {
+		if _, err := io.WriteString(b.w, utf8BOM); err != nil {
+			return 0, err
+		}
+		b.done = true
+	}
+
+	return b.w.Write(p)
+}
+
+func (h *ConsoleHandler) optionalBOMWriter(w io.Writer) io.Writer {
+	if !h.opts.WriteBOM {
+		return w
+	}
+
+	return &bomWriter{w: w}
+}
+
+// stripWriter removes color escape sequences before writing
+type stripWriter struct {
+	w io.Writer
+}
+
+// StripColor returns the writer which removes color escape sequences before
+// writing to w. It lets colored lines go to the terminal and the plain ones to
+// the file at the same time, e.g.
+//
+//	New(io.MultiWriter(os.Stderr, StripColor(file)), &Options{ColorMode: ColorAlways})
+func StripColor(w io.Writer) io.Writer {
+	return &stripWriter{w: w}
+}
+
+func (s *stripWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, stripANSI(string(p))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// IsTerminal reports false, so the colors are never auto-detected for the
+// stripped output
+func (s *stripWriter) IsTerminal() bool {
+	return false
+}